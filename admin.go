@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var adminToken = flag.String("adminToken", "",
+	"bearer token required by the /admin API, the admin API is disabled when empty")
+var readOnly = flag.Bool("readonly", false,
+	"open indexes read only and refuse every request that changes data, like document writes, imports and alias changes")
+
+// adminOnly wraps handlers of the admin API so they are only reachable with
+// the configured admin token. Read-only servers only let GET requests through.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return adminToggle(func(w http.ResponseWriter, r *http.Request) {
+		if *readOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "server is read only", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// adminToggle is like adminOnly for operational settings that change no
+// data, like the learned ranking kill switch, which read-only servers need
+// as much as any other.
+func adminToggle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *adminToken == "" {
+			http.Error(w, "admin API disabled", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// snapshotReader is like adminOnly for the snapshots replicas download,
+// which the snapshot token gets at as well as the admin token.
+func snapshotReader(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if *snapshotToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*snapshotToken)) == 1 {
+			next(w, r)
+			return
+		}
+		adminOnly(next)(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	jsonResponse, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("JSON marshaling error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
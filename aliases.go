@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// aliasFileName is the metadata file in the data dir that holds the aliases
+const aliasFileName = "aliases.json"
+
+// aliases maps alias names to the physical indexes they point to. Clients can
+// search an alias wherever they would name an index, so an index can be
+// rebuilt under a new name and swapped in by repointing the alias.
+var aliases = struct {
+	sync.RWMutex
+	m map[string][]string
+}{m: map[string][]string{}}
+
+func aliasFilePath() string {
+	return *dataDir + string(os.PathSeparator) + aliasFileName
+}
+
+func loadAliases() error {
+	data, err := ioutil.ReadFile(aliasFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	m := map[string][]string{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("parsing %s: %v", aliasFileName, err)
+	}
+
+	aliases.Lock()
+	aliases.m = m
+	aliases.Unlock()
+	return nil
+}
+
+// updateAliases applies fn to a copy of the aliases, persists the result and
+// only then makes it visible to searches, so readers never see a half
+// written alias file or a repointing that didn't make it to disk.
+func updateAliases(fn func(m map[string][]string) error) error {
+	aliases.Lock()
+	defer aliases.Unlock()
+
+	m := make(map[string][]string, len(aliases.m))
+	for name, targets := range aliases.m {
+		m[name] = targets
+	}
+	if err := fn(m); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := aliasFilePath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, aliasFilePath()); err != nil {
+		return err
+	}
+
+	aliases.m = m
+	return nil
+}
+
+// resolveIndex returns the physical indexes behind name, which is either an
+// alias or an index name.
+func resolveIndex(name string) []string {
+	aliases.RLock()
+	defer aliases.RUnlock()
+	if targets, ok := aliases.m[name]; ok {
+		return targets
+	}
+	return []string{name}
+}
+
+// acquireIndex is like indexes.Acquire but also accepts aliases. Aliases that
+// point to more than one index are searched through a bleve.IndexAlias.
+func acquireIndex(name string) (bleve.Index, func(), error) {
+	targets := resolveIndex(name)
+	if len(targets) == 1 {
+		return indexes.Acquire(targets[0])
+	}
+
+	var acquired []bleve.Index
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, target := range targets {
+		index, r, err := indexes.Acquire(target)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		acquired = append(acquired, index)
+		releases = append(releases, r)
+	}
+	return bleve.NewIndexAlias(acquired...), release, nil
+}
+
+// aliasesHandler serves the admin API for aliases:
+//
+//	GET    /admin/aliases        list all aliases
+//	PUT    /admin/aliases/{name} create or repoint an alias, body {"Indexes": [...]}
+//	DELETE /admin/aliases/{name} remove an alias
+func aliasesHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/aliases"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		aliases.RLock()
+		names := make([]string, 0, len(aliases.m))
+		for alias := range aliases.m {
+			names = append(names, alias)
+		}
+		sort.Strings(names)
+		res := make([]aliasRes, len(names))
+		for i, alias := range names {
+			res[i] = aliasRes{Name: alias, Indexes: aliases.m[alias]}
+		}
+		aliases.RUnlock()
+		writeJSON(w, http.StatusOK, res)
+
+	case r.Method == http.MethodPut && name != "":
+		var req struct {
+			Indexes []string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := validateAlias(name, req.Indexes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := updateAliases(func(m map[string][]string) error {
+			m[name] = req.Indexes
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, aliasRes{Name: name, Indexes: req.Indexes})
+
+	case r.Method == http.MethodDelete && name != "":
+		err := updateAliases(func(m map[string][]string) error {
+			if _, ok := m[name]; !ok {
+				return errAliasNotFound
+			}
+			delete(m, name)
+			return nil
+		})
+		if err == errAliasNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var errAliasNotFound = fmt.Errorf("alias not found")
+
+type aliasRes struct {
+	Name    string
+	Indexes []string
+}
+
+// validateAlias checks that an alias doesn't shadow a physical index and that
+// every index it points to can be opened. Each target may appear only once,
+// a repeated one would be searched twice and double its hits.
+func validateAlias(name string, targets []string) error {
+	if strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid alias name %q", name)
+	}
+	if info, err := os.Stat(indexes.path(name)); err == nil && info.IsDir() {
+		return fmt.Errorf("alias %q would shadow the index of the same name", name)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("alias %q must point to at least one index", name)
+	}
+	seen := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		if seen[target] {
+			return fmt.Errorf("alias %q lists index %q more than once", name, target)
+		}
+		seen[target] = true
+		_, release, err := indexes.Acquire(target)
+		if err != nil {
+			return fmt.Errorf("cannot open index %q: %v", target, err)
+		}
+		release()
+	}
+	return nil
+}
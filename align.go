@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// alignedField is the object holding the cross references of a document to
+// its counterparts in other editions, the ID of the counterpart in language
+// xx being stored as aligned.xx
+const alignedField = "aligned"
+
+// alignedPassage is the counterpart of a hit in another edition
+type alignedPassage struct {
+	Name string
+	Line string
+}
+
+// readAlignments reads a file of tab separated pairs of document IDs, the
+// first of the edition being ingested and the second of its counterpart.
+func readAlignments(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	alignments := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected two tab separated document IDs", path, n)
+		}
+		alignments[parts[0]] = parts[1]
+	}
+	return alignments, scanner.Err()
+}
+
+// withAlignments stores the ID of each document's counterpart in the lang
+// edition, looked up in alignments.
+func withAlignments(sources []ingestSource, lang string, alignments map[string]string) []ingestSource {
+	return withAlignedIDs(sources, lang, func(source ingestSource, id string) string {
+		return alignments[id]
+	})
+}
+
+// withPositionalAlignments aligns each line of a source with the same line of
+// the counterpart file in dir, files being paired up in name order. It only
+// makes sense for the lines profile, where both editions have the same
+// paragraph on the same line.
+func withPositionalAlignments(sources []ingestSource, lang string, dir string) ([]ingestSource, error) {
+	counterparts, err := lineSources(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(counterparts) != len(sources) {
+		log.Printf("aligning %d files with %d counterpart files, extra files stay unaligned",
+			len(sources), len(counterparts))
+	}
+	pairs := map[string]string{}
+	for i := 0; i < len(sources) && i < len(counterparts); i++ {
+		pairs[sources[i].name] = counterparts[i].name
+	}
+
+	return withAlignedIDs(sources, lang, func(source ingestSource, id string) string {
+		pair, ok := pairs[source.name]
+		if !ok {
+			return ""
+		}
+		n, err := strconv.Atoi(id[strings.LastIndex(id, ": ")+2:])
+		if err != nil {
+			return ""
+		}
+		return lineDocID(pair, n)
+	}), nil
+}
+
+func withAlignedIDs(sources []ingestSource, lang string, counterpart func(ingestSource, string) string) []ingestSource {
+	wrapped := make([]ingestSource, len(sources))
+	for i, source := range sources {
+		source := source
+		read := source.read
+		source.read = func(emit func(string, map[string]interface{}) error) error {
+			return read(func(id string, doc map[string]interface{}) error {
+				if counterpartID := counterpart(source, id); counterpartID != "" {
+					doc[alignedField] = map[string]interface{}{lang: counterpartID}
+				}
+				return emit(id, doc)
+			})
+		}
+		wrapped[i] = source
+	}
+	return wrapped
+}
+
+// alignHits finds the counterparts in the lang edition of the hits of a
+// search that requested the aligned.<lang> and language fields. Cross
+// references are followed both ways: from hits that point at their
+// counterpart, and to hits from the counterparts that point at them.
+func alignHits(index bleve.Index, hits search.DocumentMatchCollection, lang string) (map[string]alignedPassage, error) {
+	forward := map[string][]string{} // counterpart ID -> IDs of the hits pointing at it
+	reverse := map[string][]*search.DocumentMatch{}
+	for _, hit := range hits {
+		if id, ok := hit.Fields[alignedField+"."+lang].(string); ok {
+			forward[id] = append(forward[id], hit.ID)
+			continue
+		}
+		if hitLang, ok := hit.Fields[languageField].(string); ok && hitLang != lang {
+			reverse[hitLang] = append(reverse[hitLang], hit)
+		}
+	}
+
+	aligned := map[string]alignedPassage{}
+	if len(forward) > 0 {
+		ids := make([]string, 0, len(forward))
+		for id := range forward {
+			ids = append(ids, id)
+		}
+		req := bleve.NewSearchRequestOptions(bleve.NewDocIDQuery(ids), len(ids), 0, false)
+		req.Fields = []string{"Line"}
+		res, err := index.Search(req)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range res.Hits {
+			line, _ := doc.Fields["Line"].(string)
+			for _, hitID := range forward[doc.ID] {
+				aligned[hitID] = alignedPassage{Name: doc.ID, Line: line}
+			}
+		}
+	}
+
+	for hitLang, langHits := range reverse {
+		field := alignedField + "." + hitLang
+		refs := make([]query.Query, len(langHits))
+		for i, hit := range langHits {
+			ref := bleve.NewTermQuery(hit.ID)
+			ref.SetField(field)
+			refs[i] = ref
+		}
+		langQuery := bleve.NewTermQuery(lang)
+		langQuery.SetField(languageField)
+		q := bleve.NewConjunctionQuery(bleve.NewDisjunctionQuery(refs...), langQuery)
+		req := bleve.NewSearchRequestOptions(q, len(langHits), 0, false)
+		req.Fields = []string{"Line", field}
+		res, err := index.Search(req)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range res.Hits {
+			hitID, _ := doc.Fields[field].(string)
+			line, _ := doc.Fields["Line"].(string)
+			if _, done := aligned[hitID]; hitID != "" && !done {
+				aligned[hitID] = alignedPassage{Name: doc.ID, Line: line}
+			}
+		}
+	}
+	return aligned, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2/analysis"
+)
+
+var tokenTypeNames = map[analysis.TokenType]string{
+	analysis.AlphaNumeric: "alphanumeric",
+	analysis.Ideographic:  "ideographic",
+	analysis.Numeric:      "numeric",
+	analysis.DateTime:     "datetime",
+	analysis.Shingle:      "shingle",
+	analysis.Single:       "single",
+	analysis.Double:       "double",
+	analysis.Boolean:      "boolean",
+	analysis.IP:           "ip",
+}
+
+type analyzeRequest struct {
+	Text     string `json:"text"`
+	Field    string `json:"field"`
+	Analyzer string `json:"analyzer"`
+}
+
+type analyzedToken struct {
+	Term     string
+	Position int
+	Start    int // byte offsets of the token in the text
+	End      int
+	Type     string
+	Keyword  bool `json:",omitempty"`
+}
+
+// analyzeHandler serves POST /analyze/{index}. It takes {"text":...,
+// "field":..., "analyzer":...} and returns the tokens the analyzer of the
+// field, or the named one, turns the text into. The field defaults to the
+// default search field of the index.
+func analyzeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	indexName := strings.TrimPrefix(r.URL.Path, "/analyze/")
+	if indexName == "" || strings.Contains(indexName, "/") {
+		http.Error(w, "expected /analyze/{index}", http.StatusNotFound)
+		return
+	}
+
+	var req analyzeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	index, release, err := acquireIndex(indexName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer release()
+	m := index.Mapping()
+	if m == nil {
+		http.Error(w, fmt.Sprintf("%s points to several indexes, analyze one of them", indexName), http.StatusBadRequest)
+		return
+	}
+
+	field := req.Field
+	if field == "" {
+		field = m.DefaultSearchField()
+	}
+	analyzerName := req.Analyzer
+	if analyzerName == "" {
+		analyzerName = m.AnalyzerNameForPath(field)
+	}
+	analyzer := m.AnalyzerNamed(analyzerName)
+	if analyzer == nil {
+		http.Error(w, fmt.Sprintf("unknown analyzer %q", analyzerName), http.StatusBadRequest)
+		return
+	}
+
+	tokens := []analyzedToken{}
+	for _, token := range analyzer.Analyze([]byte(req.Text)) {
+		tokens = append(tokens, analyzedToken{
+			Term:     string(token.Term),
+			Position: token.Position,
+			Start:    token.Start,
+			End:      token.End,
+			Type:     tokenTypeNames[token.Type],
+			Keyword:  token.KeyWord,
+		})
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Index    string
+		Field    string
+		Analyzer string
+		Tokens   []analyzedToken
+	}{indexName, field, analyzerName, tokens})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+var maxQueryTerms = flag.Int("maxQueryTerms", 0,
+	"searches expanding to more terms than this, through wildcards, prefixes, regular expressions or fuzziness, are rejected, 0 for no limit")
+var maxQueryHits = flag.Uint64("maxQueryHits", 0,
+	"searches that may return more hits than this are rejected, 0 for no limit")
+var memoryLimit = flag.Uint64("memoryLimit", 0,
+	"heap size in bytes past which searches are rejected, as are those whose hits would not fit under it, 0 for no limit")
+
+// bytesPerHit is roughly what a hit costs in memory once loaded with its
+// stored fields, term locations and highlighted fragments
+const bytesPerHit = 4096
+
+// breakerError is why the breaker rejected a search, with the HTTP status to
+// reject it with: 422 when the query itself is too expensive and 503 when
+// the server is short of memory.
+type breakerError struct {
+	status int
+	reason string
+}
+
+func (e *breakerError) Error() string {
+	return e.reason
+}
+
+type breakerRejection struct {
+	Time   time.Time
+	Index  string
+	Reason string
+}
+
+var breaker = struct {
+	heapAlloc uint64 // sampled by watchHeap, updated atomically
+
+	sync.Mutex
+	checked  uint64
+	rejected map[string]uint64 // by what tripped it: terms, hits or memory
+	last     *breakerRejection
+}{
+	rejected: map[string]uint64{},
+}
+
+// startBreaker samples the heap size, which runtime.ReadMemStats is too slow
+// to do on every search.
+func startBreaker() {
+	if *memoryLimit == 0 {
+		return
+	}
+	sampleHeap()
+	go func() {
+		for range time.Tick(100 * time.Millisecond) {
+			sampleHeap()
+		}
+	}()
+}
+
+func sampleHeap() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	atomic.StoreUint64(&breaker.heapAlloc, m.HeapAlloc)
+}
+
+// checkBreaker estimates the cost of running q on indexName for up to size
+// hits and returns a *breakerError when it is over a limit or when the heap
+// has no room left for its hits.
+func checkBreaker(indexName string, q query.Query, size int) error {
+	if *maxQueryTerms == 0 && *maxQueryHits == 0 && *memoryLimit == 0 {
+		return nil
+	}
+	breaker.Lock()
+	breaker.checked++
+	breaker.Unlock()
+
+	heap := atomic.LoadUint64(&breaker.heapAlloc)
+	if *memoryLimit > 0 && heap >= *memoryLimit {
+		return rejectSearch(indexName, "memory", http.StatusServiceUnavailable,
+			fmt.Sprintf("server is short of memory, heap at %d of %d bytes, try again later", heap, *memoryLimit))
+	}
+
+	cost, err := estimateCost(indexName, q)
+	if err != nil {
+		return err
+	}
+	hits := cost.Candidates
+	if size >= 0 && uint64(size) < hits {
+		hits = uint64(size)
+	}
+	switch {
+	case *maxQueryTerms > 0 && cost.Terms > *maxQueryTerms:
+		return rejectSearch(indexName, "terms", http.StatusUnprocessableEntity,
+			fmt.Sprintf("query expands to %d terms, more than the limit of %d, make wildcards and prefixes more specific", cost.Terms, *maxQueryTerms))
+	case *maxQueryHits > 0 && hits > *maxQueryHits:
+		return rejectSearch(indexName, "hits", http.StatusUnprocessableEntity,
+			fmt.Sprintf("query may return %d hits, more than the limit of %d, make it more specific", hits, *maxQueryHits))
+	case *memoryLimit > 0 && hits*bytesPerHit > *memoryLimit-heap:
+		return rejectSearch(indexName, "memory", http.StatusServiceUnavailable,
+			fmt.Sprintf("%d hits would take about %d bytes, more than the %d left, try again later or make the query more specific", hits, hits*bytesPerHit, *memoryLimit-heap))
+	}
+	return nil
+}
+
+func rejectSearch(indexName string, kind string, status int, reason string) error {
+	log.Printf("breaker rejected search on %s: %s", indexName, reason)
+	breaker.Lock()
+	breaker.rejected[kind]++
+	breaker.last = &breakerRejection{Time: time.Now(), Index: indexName, Reason: reason}
+	breaker.Unlock()
+	return &breakerError{status: status, reason: reason}
+}
+
+// breakerState is what the breaker exposes in /indexes, and in /debug/vars
+// with -debug
+func breakerState() interface{} {
+	heap := atomic.LoadUint64(&breaker.heapAlloc)
+	breaker.Lock()
+	defer breaker.Unlock()
+	rejected := map[string]uint64{}
+	for kind, n := range breaker.rejected {
+		rejected[kind] = n
+	}
+	return map[string]interface{}{
+		"maxQueryTerms": *maxQueryTerms,
+		"maxQueryHits":  *maxQueryHits,
+		"memoryLimit":   *memoryLimit,
+		"heapAlloc":     heap,
+		"tripped":       *memoryLimit > 0 && heap >= *memoryLimit,
+		"checked":       breaker.checked,
+		"rejected":      rejected,
+		"lastRejection": breaker.last,
+	}
+}
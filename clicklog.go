@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var clickLogPath = flag.String("clickLog", "",
+	"optional path of a file to append the click beacons of the UI to, one JSON object per line; clicks are accepted but dropped when empty")
+
+// clickLogEntry records a click on a search hit along with the hits that
+// were shown to the user, in order, so skipped hits can be told apart from
+// unseen ones.
+type clickLogEntry struct {
+	Time  time.Time `json:"time"`
+	Index string    `json:"index"`
+	Query string    `json:"q"`
+	ID    string    `json:"id"`
+	Rank  int       `json:"rank"`
+	Shown []string  `json:"shown"`
+
+	// the A/B experiment variant of the search, as it was returned with the
+	// hits
+	Experiment string `json:"experiment,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+}
+
+// maxShownHits caps the hits recorded per click
+const maxShownHits = 100
+
+var clickLog struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+func openClickLog() error {
+	if *clickLogPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*clickLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	clickLog.enc = json.NewEncoder(f)
+	return nil
+}
+
+func logClick(entry clickLogEntry) {
+	clickLog.Lock()
+	defer clickLog.Unlock()
+	if clickLog.enc == nil {
+		return
+	}
+	if err := clickLog.enc.Encode(entry); err != nil {
+		log.Printf("click log write error: %v", err)
+	}
+}
+
+// readClickLog calls fn for every well formed entry in the click log at path.
+func readClickLog(path string, fn func(clickLogEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry clickLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		fn(entry)
+	}
+	return scanner.Err()
+}
+
+// clickHandler serves POST /click, the beacon the UI sends when a hit is
+// clicked. The body is JSON whatever the content type, as navigator.sendBeacon
+// only sends simple content types without a preflight.
+func clickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var entry clickLogEntry
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&entry); err != nil {
+		http.Error(w, fmt.Sprintf("invalid click: %v", err), http.StatusBadRequest)
+		return
+	}
+	if entry.Index == "" || entry.Query == "" || entry.ID == "" || entry.Rank < 0 {
+		http.Error(w, "invalid click: index, q, id and rank are required", http.StatusBadRequest)
+		return
+	}
+	if len(entry.Shown) > maxShownHits {
+		entry.Shown = entry.Shown[:maxShownHits]
+	}
+	entry.Time = time.Now()
+	logClick(entry)
+	w.WriteHeader(http.StatusNoContent)
+}
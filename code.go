@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/analysis/token/lowercase"
+	regexptokenizer "github.com/blevesearch/bleve/v2/analysis/tokenizer/regexp"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/registry"
+)
+
+// identifierFilterName is the token filter that splits identifiers into their
+// camelCase and snake_case parts
+const identifierFilterName = "identifier_split"
+
+// codeAnalyzerName is the analyzer for lines of source code
+const codeAnalyzerName = "code"
+
+func init() {
+	registry.RegisterTokenFilter(identifierFilterName,
+		func(config map[string]interface{}, cache *registry.Cache) (analysis.TokenFilter, error) {
+			return identifierFilter{}, nil
+		})
+}
+
+// identifierFilter keeps every token and adds the words it is made of, at the
+// same position, so getUserName matches searches for getusername, user and
+// user name alike. Likewise for get_user_name and HTTPServer.
+type identifierFilter struct{}
+
+func (identifierFilter) Filter(input analysis.TokenStream) analysis.TokenStream {
+	rv := make(analysis.TokenStream, 0, len(input))
+	for _, token := range input {
+		rv = append(rv, token)
+		parts := splitIdentifier(token.Term)
+		if len(parts) == 1 && parts[0] == [2]int{0, len(token.Term)} {
+			continue
+		}
+		for _, part := range parts {
+			rv = append(rv, &analysis.Token{
+				Term:     token.Term[part[0]:part[1]],
+				Start:    token.Start + part[0],
+				End:      token.Start + part[1],
+				Position: token.Position,
+				Type:     token.Type,
+			})
+		}
+	}
+	return rv
+}
+
+// splitIdentifier returns the byte ranges of the words in an identifier,
+// split at underscores, at lower to upper case changes and before the last
+// upper case letter of an acronym followed by a lower case one.
+func splitIdentifier(term []byte) [][2]int {
+	var parts [][2]int
+	start := -1
+	var prev, prevPrev rune
+	for i := 0; i < len(term); {
+		r, size := utf8.DecodeRune(term[i:])
+		switch {
+		case r == '_':
+			if start >= 0 {
+				parts = append(parts, [2]int{start, i})
+			}
+			start = -1
+		case start < 0:
+			start = i
+		case unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)):
+			parts = append(parts, [2]int{start, i})
+			start = i
+		case unicode.IsLower(r) && unicode.IsUpper(prev) && unicode.IsUpper(prevPrev):
+			prevStart := i - utf8.RuneLen(prev)
+			parts = append(parts, [2]int{start, prevStart})
+			start = prevStart
+		}
+		prevPrev, prev = prev, r
+		if r == '_' {
+			prevPrev, prev = 0, 0
+		}
+		i += size
+	}
+	if start >= 0 {
+		parts = append(parts, [2]int{start, len(term)})
+	}
+	return parts
+}
+
+// codeIndexMapping indexes lines of source code: Line with the identifier
+// aware code analyzer, path and lang as exact keywords and line as a number.
+func codeIndexMapping() *mapping.IndexMappingImpl {
+	indexMapping := bleve.NewIndexMapping()
+	err := indexMapping.AddCustomTokenizer("identifier", map[string]interface{}{
+		"type":   regexptokenizer.Name,
+		"regexp": `[\p{L}\p{N}_]+`,
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = indexMapping.AddCustomAnalyzer(codeAnalyzerName, map[string]interface{}{
+		"type":          custom.Name,
+		"tokenizer":     "identifier",
+		"token_filters": []string{identifierFilterName, lowercase.Name},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	lineField := bleve.NewTextFieldMapping()
+	lineField.Analyzer = codeAnalyzerName
+	keywordField := bleve.NewTextFieldMapping()
+	keywordField.Analyzer = keyword.Name
+
+	indexMapping.DefaultMapping.AddFieldMappingsAt("Line", lineField)
+	indexMapping.DefaultMapping.AddFieldMappingsAt("path", keywordField)
+	indexMapping.DefaultMapping.AddFieldMappingsAt("lang", keywordField)
+	indexMapping.DefaultMapping.AddFieldMappingsAt("line", bleve.NewNumericFieldMapping())
+	indexMapping.DefaultAnalyzer = codeAnalyzerName
+	return indexMapping
+}
+
+// languages maps file extensions, or whole file names, to the language
+// stored with each line
+var languages = map[string]string{
+	".c": "C", ".h": "C", ".cc": "C++", ".cpp": "C++", ".cxx": "C++", ".hpp": "C++",
+	".cs": "C#", ".css": "CSS", ".go": "Go", ".html": "HTML", ".java": "Java",
+	".js": "JavaScript", ".jsx": "JavaScript", ".mjs": "JavaScript", ".json": "JSON",
+	".kt": "Kotlin", ".lua": "Lua", ".md": "Markdown", ".php": "PHP", ".pl": "Perl",
+	".proto": "Protocol Buffers", ".py": "Python", ".rb": "Ruby", ".rs": "Rust",
+	".scala": "Scala", ".sh": "Shell", ".bash": "Shell", ".sql": "SQL",
+	".swift": "Swift", ".toml": "TOML", ".ts": "TypeScript", ".tsx": "TypeScript",
+	".txt": "Text", ".xml": "XML", ".yaml": "YAML", ".yml": "YAML",
+	"Dockerfile": "Dockerfile", "Makefile": "Makefile",
+}
+
+func detectLanguage(path string) string {
+	name := filepath.Base(path)
+	if lang, ok := languages[name]; ok {
+		return lang
+	}
+	return languages[strings.ToLower(filepath.Ext(name))]
+}
+
+// codeSources returns a source per file of a known language under dir,
+// skipping whatever the .gitignore files of the tree ignore. Each non blank
+// line becomes a document with the ID path:line.
+func codeSources(dir string) ([]ingestSource, error) {
+	var sources []ingestSource
+	ignores := map[string][]gitignoreRule{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if rel != "." && gitignored(ignores, rel, true) {
+				return filepath.SkipDir
+			}
+			rules, err := readGitignore(filepath.Join(path, ".gitignore"), rel)
+			if err != nil {
+				return err
+			}
+			ignores[rel] = rules
+			return nil
+		}
+		if !info.Mode().IsRegular() || gitignored(ignores, rel, false) {
+			return nil
+		}
+		lang := detectLanguage(path)
+		if lang == "" {
+			return nil
+		}
+		sources = append(sources, ingestSource{
+			name: path,
+			size: info.Size(),
+			read: func(emit func(string, map[string]interface{}) error) error {
+				return readCodeDocs(path, rel, lang, emit)
+			},
+		})
+		return nil
+	})
+	sort.Slice(sources, func(i, j int) bool { return sources[i].name < sources[j].name })
+	return sources, err
+}
+
+func readCodeDocs(path, rel, lang string, emit func(string, map[string]interface{}) error) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// skip binary files that happen to have a source file extension
+	head := data
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		doc := map[string]interface{}{
+			"Line": text,
+			"path": rel,
+			"line": n,
+			"lang": lang,
+		}
+		if err := emit(fmt.Sprintf("%s:%d", rel, n), doc); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// gitignoreRule is one pattern of a .gitignore file
+type gitignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// readGitignore parses the .gitignore at path, if there is one. base is the
+// slash separated directory of the file relative to the root of the walk.
+func readGitignore(path string, base string) ([]gitignoreRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if base != "." {
+		prefix = regexp.QuoteMeta(base) + "/"
+	}
+	var rules []gitignoreRule
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := gitignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, `\`)
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// patterns with a slash before the end are relative to the
+		// .gitignore, the others match a name at any depth below it
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		expr := "^" + prefix
+		if !anchored {
+			expr += "(?:.*/)?"
+		}
+		expr += globToRegexp(line) + "$"
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			continue
+		}
+		rule.re = re
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**"):
+			sb.WriteString("(?:/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// gitignored reports whether rel is ignored by the rules of the .gitignore
+// files in its ancestor directories. Deeper files and later rules win.
+func gitignored(ignores map[string][]gitignoreRule, rel string, isDir bool) bool {
+	dirs := []string{"."}
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		dirs = append(dirs, strings.Join(parts[:i], "/"))
+	}
+
+	ignored := false
+	for _, dir := range dirs {
+		for _, rule := range ignores[dir] {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.re.MatchString(rel) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
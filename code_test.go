@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitIdentifier(t *testing.T) {
+	tests := []struct {
+		identifier string
+		want       []string
+	}{
+		{"simple", []string{"simple"}},
+		{"getUserName", []string{"get", "User", "Name"}},
+		{"get_user_name", []string{"get", "user", "name"}},
+		{"__init__", []string{"init"}},
+		{"HTTPServer", []string{"HTTP", "Server"}},
+		{"parseHTTP2Request", []string{"parse", "HTTP2", "Request"}},
+		{"ABC", []string{"ABC"}},
+		{"utf8Décodé", []string{"utf8", "Décodé"}},
+		{"", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, part := range splitIdentifier([]byte(test.identifier)) {
+			got = append(got, test.identifier[part[0]:part[1]])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitIdentifier(%q) = %q, want %q", test.identifier, got, test.want)
+		}
+	}
+}
+
+func TestGitignored(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("root.gitignore", "# build output\n*.log\n!keep.log\nbuild/\n/vendor\ndocs/**/*.tmp\n")
+	write("sub.gitignore", "*.gen.go\n!important.log\n")
+
+	ignores := map[string][]gitignoreRule{}
+	for base, name := range map[string]string{".": "root.gitignore", "sub": "sub.gitignore", "empty": "missing"} {
+		rules, err := readGitignore(filepath.Join(dir, name), base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ignores[base] = rules
+	}
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"main.go", false, false},
+		{"app.log", false, true},
+		{"sub/deep/app.log", false, true},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"vendor", true, true},
+		{"sub/vendor", true, false},
+		{"docs/x.tmp", false, true},
+		{"docs/a/b/x.tmp", false, true},
+		{"x.tmp", false, false},
+		{"sub/x.gen.go", false, true},
+		{"x.gen.go", false, false},
+		{"sub/important.log", false, false},
+		{"empty/app.log", false, true},
+	}
+	for _, test := range tests {
+		if got := gitignored(ignores, test.rel, test.isDir); got != test.want {
+			t.Errorf("gitignored(%q, dir %v) = %v, want %v", test.rel, test.isDir, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/index/scorch"
+	"github.com/blevesearch/bleve/v2/index/scorch/mergeplan"
+)
+
+// compactHandler serves POST /admin/compact/{index}, which merges the
+// segments of an index into one. Writes to the index wait until it is done,
+// searches go on.
+func compactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/admin/compact/")
+	if name == "" || strings.Contains(name, "/") {
+		http.Error(w, "expected /admin/compact/{index}", http.StatusNotFound)
+		return
+	}
+
+	defer indexes.FenceWrites(name)()
+	index, release, err := indexes.Acquire(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer release()
+
+	start := time.Now()
+	before, err := segmentCount(index)
+	if err == nil {
+		err = compactIndex(r, index)
+	}
+	if err != nil {
+		log.Printf("error compacting %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	after, _ := segmentCount(index)
+	log.Printf("compacted %s from %d segments to %d in %s", name, before, after, time.Since(start))
+	writeJSON(w, http.StatusOK, struct {
+		Index          string
+		SegmentsBefore int
+		SegmentsAfter  int
+		Took           string
+	}{name, before, after, time.Since(start).Round(time.Millisecond).String()})
+}
+
+func scorchIndex(index bleve.Index) (*scorch.Scorch, error) {
+	advanced, err := index.Advanced()
+	if err != nil {
+		return nil, err
+	}
+	s, ok := advanced.(*scorch.Scorch)
+	if !ok {
+		return nil, fmt.Errorf("only scorch indexes can be compacted")
+	}
+	return s, nil
+}
+
+func compactIndex(r *http.Request, index bleve.Index) error {
+	s, err := scorchIndex(index)
+	if err != nil {
+		return err
+	}
+	return s.ForceMerge(r.Context(), &mergeplan.SingleSegmentMergePlanOptions)
+}
+
+func segmentCount(index bleve.Index) (int, error) {
+	s, err := scorchIndex(index)
+	if err != nil {
+		return 0, err
+	}
+	reader, err := s.Reader()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return len(reader.(*scorch.IndexSnapshot).Segments()), nil
+}
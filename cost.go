@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+	index "github.com/blevesearch/bleve_index_api"
+)
+
+// queryCost is an estimate of what a query costs to run, made from the term
+// dictionary before running it
+type queryCost struct {
+	// Terms is the number of terms whose postings the query reads, after
+	// expanding prefixes, wildcards, regular expressions and fuzzy terms
+	Terms int
+
+	// Candidates is an upper bound on the number of documents it matches
+	Candidates uint64
+}
+
+// estimateCost estimates the cost of q on the index or alias named
+// indexName, adding up that of q on every index an alias points to.
+func estimateCost(indexName string, q query.Query) (queryCost, error) {
+	var total queryCost
+	for _, target := range resolveIndex(indexName) {
+		idx, release, err := indexes.Acquire(target)
+		if err != nil {
+			return total, err
+		}
+		cost, err := estimateIndexCost(idx, q)
+		release()
+		if err != nil {
+			return total, err
+		}
+		total.Terms += cost.Terms
+		total.Candidates += cost.Candidates
+	}
+	return total, nil
+}
+
+func estimateIndexCost(idx bleve.Index, q query.Query) (queryCost, error) {
+	advanced, err := idx.Advanced()
+	if err != nil {
+		return queryCost{}, err
+	}
+	reader, err := advanced.Reader()
+	if err != nil {
+		return queryCost{}, err
+	}
+	defer reader.Close()
+	docCount, err := reader.DocCount()
+	if err != nil {
+		return queryCost{}, err
+	}
+
+	e := &costEstimator{reader: reader, mapping: idx.Mapping(), docCount: docCount}
+	return e.cost(q)
+}
+
+type costEstimator struct {
+	reader   index.IndexReader
+	mapping  mapping.IndexMapping
+	docCount uint64
+}
+
+func (e *costEstimator) cost(q query.Query) (queryCost, error) {
+	switch q := q.(type) {
+	case *query.QueryStringQuery:
+		parsed, err := q.Parse()
+		if err != nil {
+			return queryCost{}, err
+		}
+		return e.cost(parsed)
+
+	case *query.ConjunctionQuery:
+		return e.combine(q.Conjuncts, true)
+	case *query.DisjunctionQuery:
+		return e.combine(q.Disjuncts, false)
+	case *query.BooleanQuery:
+		var parts []queryCost
+		for _, clause := range []query.Query{q.Must, q.Should, q.MustNot} {
+			if emptyClause(clause) {
+				parts = append(parts, queryCost{})
+				continue
+			}
+			c, err := e.cost(clause)
+			if err != nil {
+				return queryCost{}, err
+			}
+			parts = append(parts, c)
+		}
+		c := queryCost{Terms: parts[0].Terms + parts[1].Terms + parts[2].Terms}
+		switch {
+		case !emptyClause(q.Must):
+			c.Candidates = parts[0].Candidates
+		case !emptyClause(q.Should):
+			c.Candidates = parts[1].Candidates
+		default:
+			c.Candidates = e.docCount
+		}
+		return c, nil
+
+	case *query.MatchQuery:
+		field := e.field(q.FieldVal)
+		tokens := analyzeText(e.mapping, q.Match, field, q.Analyzer)
+		var terms []queryCost
+		for _, token := range tokens {
+			var c queryCost
+			var err error
+			if q.Fuzziness > 0 {
+				c, err = e.fuzzy(field, token, q.Fuzziness, q.Prefix)
+			} else {
+				c, err = e.term(field, token)
+			}
+			if err != nil {
+				return queryCost{}, err
+			}
+			terms = append(terms, c)
+		}
+		return e.merge(terms, q.Operator == query.MatchQueryOperatorAnd), nil
+	case *query.MatchPhraseQuery:
+		field := e.field(q.FieldVal)
+		return e.terms(field, analyzeText(e.mapping, q.MatchPhrase, field, q.Analyzer), true)
+	case *query.PhraseQuery:
+		return e.terms(e.field(q.Field), q.Terms, true)
+	case *query.MultiPhraseQuery:
+		field := e.field(q.Field)
+		var positions []queryCost
+		for _, alternatives := range q.Terms {
+			c, err := e.terms(field, alternatives, false)
+			if err != nil {
+				return queryCost{}, err
+			}
+			positions = append(positions, c)
+		}
+		return e.merge(positions, true), nil
+	case *query.TermQuery:
+		return e.term(e.field(q.FieldVal), q.Term)
+
+	case *query.PrefixQuery:
+		return e.dict(e.reader.FieldDictPrefix(e.field(q.FieldVal), []byte(q.Prefix)))
+	case *query.TermRangeQuery:
+		var max []byte
+		if q.Max != "" {
+			max = []byte(q.Max)
+		}
+		return e.dict(e.reader.FieldDictRange(e.field(q.FieldVal), []byte(q.Min), max))
+	case *query.WildcardQuery:
+		return e.regexp(e.field(q.FieldVal), wildcardToRegexp(q.Wildcard))
+	case *query.RegexpQuery:
+		return e.regexp(e.field(q.FieldVal), strings.TrimSuffix(strings.TrimPrefix(q.Regexp, "^"), "$"))
+	case *query.FuzzyQuery:
+		return e.fuzzy(e.field(q.FieldVal), q.Term, q.Fuzziness, q.Prefix)
+
+	case *query.DocIDQuery:
+		return queryCost{Candidates: uint64(len(q.IDs))}, nil
+	case *query.MatchNoneQuery:
+		return queryCost{}, nil
+	}
+	// match all, numeric, date and geo queries may match every document
+	return queryCost{Candidates: e.docCount}, nil
+}
+
+// emptyClause tells whether a clause of a boolean query is missing, which
+// the query string parser does with empty conjunctions and disjunctions
+func emptyClause(q query.Query) bool {
+	switch q := q.(type) {
+	case nil:
+		return true
+	case *query.ConjunctionQuery:
+		return len(q.Conjuncts) == 0
+	case *query.DisjunctionQuery:
+		return len(q.Disjuncts) == 0
+	}
+	return false
+}
+
+func (e *costEstimator) field(field string) string {
+	if field == "" {
+		return e.mapping.DefaultSearchField()
+	}
+	return field
+}
+
+// analyzeText runs text through the named analyzer, or the one of field when
+// analyzerName is empty, and returns the terms it produces
+func analyzeText(m mapping.IndexMapping, text string, field string, analyzerName string) []string {
+	if analyzerName == "" {
+		analyzerName = m.AnalyzerNameForPath(field)
+	}
+	analyzer := m.AnalyzerNamed(analyzerName)
+	if analyzer == nil {
+		return nil
+	}
+	var terms []string
+	for _, token := range analyzer.Analyze([]byte(text)) {
+		terms = append(terms, string(token.Term))
+	}
+	return terms
+}
+
+func (e *costEstimator) term(field string, term string) (queryCost, error) {
+	reader, err := e.reader.TermFieldReader(context.Background(), []byte(term), field, false, false, false)
+	if err != nil {
+		return queryCost{}, err
+	}
+	defer reader.Close()
+	return queryCost{Terms: 1, Candidates: reader.Count()}, nil
+}
+
+// terms is the cost of looking up every term, all of them matching when
+// conjunction is set and any of them otherwise
+func (e *costEstimator) terms(field string, terms []string, conjunction bool) (queryCost, error) {
+	costs := make([]queryCost, len(terms))
+	for i, term := range terms {
+		c, err := e.term(field, term)
+		if err != nil {
+			return queryCost{}, err
+		}
+		costs[i] = c
+	}
+	return e.merge(costs, conjunction), nil
+}
+
+func (e *costEstimator) combine(queries []query.Query, conjunction bool) (queryCost, error) {
+	costs := make([]queryCost, len(queries))
+	for i, q := range queries {
+		c, err := e.cost(q)
+		if err != nil {
+			return queryCost{}, err
+		}
+		costs[i] = c
+	}
+	return e.merge(costs, conjunction), nil
+}
+
+// merge adds up the terms of costs. Documents must match all of them in a
+// conjunction, so there are no more candidates than the fewest of any, and
+// any of them otherwise.
+func (e *costEstimator) merge(costs []queryCost, conjunction bool) queryCost {
+	var c queryCost
+	for i, part := range costs {
+		c.Terms += part.Terms
+		if conjunction {
+			if i == 0 || part.Candidates < c.Candidates {
+				c.Candidates = part.Candidates
+			}
+		} else {
+			c.Candidates += part.Candidates
+		}
+	}
+	if c.Candidates > e.docCount {
+		c.Candidates = e.docCount
+	}
+	return c
+}
+
+// dict is the cost of reading the postings of every term of a dictionary
+func (e *costEstimator) dict(dict index.FieldDict, err error) (queryCost, error) {
+	if err != nil {
+		return queryCost{}, err
+	}
+	defer dict.Close()
+
+	var c queryCost
+	for {
+		entry, err := dict.Next()
+		if err != nil {
+			return queryCost{}, err
+		}
+		if entry == nil {
+			break
+		}
+		c.Terms++
+		c.Candidates += entry.Count
+	}
+	if c.Candidates > e.docCount {
+		c.Candidates = e.docCount
+	}
+	return c, nil
+}
+
+func (e *costEstimator) regexp(field string, expr string) (queryCost, error) {
+	r, ok := e.reader.(index.IndexReaderRegexp)
+	if !ok {
+		return queryCost{Candidates: e.docCount}, nil
+	}
+	return e.dict(r.FieldDictRegexp(field, expr))
+}
+
+func (e *costEstimator) fuzzy(field string, term string, fuzziness int, prefix int) (queryCost, error) {
+	r, ok := e.reader.(index.IndexReaderFuzzy)
+	if !ok {
+		return queryCost{Candidates: e.docCount}, nil
+	}
+	prefixTerm := ""
+	if prefix > 0 && prefix <= len(term) {
+		prefixTerm = term[:prefix]
+	}
+	return e.dict(r.FieldDictFuzzy(field, term, fuzziness, prefixTerm))
+}
+
+// wildcardToRegexp translates the * and ? of a wildcard query, like bleve
+// does when running one
+func wildcardToRegexp(wildcard string) string {
+	expr := regexp.QuoteMeta(wildcard)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	return strings.ReplaceAll(expr, `\?`, ".")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+func TestCostEstimator(t *testing.T) {
+	idx, err := bleve.New(filepath.Join(t.TempDir(), "cost.bleve"), bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	for id, line := range map[string]string{
+		"1": "apple banana",
+		"2": "apple cherry",
+		"3": "banana cherry date",
+		"4": "apricot",
+	} {
+		if err := idx.Index(id, map[string]interface{}{"Line": line}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	term := func(term string) query.Query {
+		q := bleve.NewTermQuery(term)
+		q.SetField("Line")
+		return q
+	}
+	match := func(text string, and bool) query.Query {
+		q := bleve.NewMatchQuery(text)
+		q.SetField("Line")
+		if and {
+			q.SetOperator(query.MatchQueryOperatorAnd)
+		}
+		return q
+	}
+	phrase := bleve.NewMatchPhraseQuery("banana cherry")
+	phrase.SetField("Line")
+	prefix := bleve.NewPrefixQuery("ap")
+	prefix.SetField("Line")
+	wildcard := bleve.NewWildcardQuery("*an*")
+	wildcard.SetField("Line")
+	regexp := bleve.NewRegexpQuery("ch.*")
+	regexp.SetField("Line")
+	fuzzy := bleve.NewFuzzyQuery("aple")
+	fuzzy.SetField("Line")
+	mustNot := bleve.NewBooleanQuery()
+	mustNot.AddMust(term("apple"))
+	mustNot.AddMustNot(term("cherry"))
+	onlyMustNot := bleve.NewBooleanQuery()
+	onlyMustNot.AddMustNot(term("cherry"))
+
+	tests := []struct {
+		name string
+		q    query.Query
+		want queryCost
+	}{
+		{"term", term("apple"), queryCost{Terms: 1, Candidates: 2}},
+		{"missing term", term("fig"), queryCost{Terms: 1, Candidates: 0}},
+		{"match any, capped at the doc count", match("apple banana cherry", false), queryCost{Terms: 3, Candidates: 4}},
+		{"match every term", match("apple banana", true), queryCost{Terms: 2, Candidates: 2}},
+		{"phrase", phrase, queryCost{Terms: 2, Candidates: 2}},
+		{"prefix", prefix, queryCost{Terms: 2, Candidates: 3}},
+		{"wildcard", wildcard, queryCost{Terms: 1, Candidates: 2}},
+		{"regexp", regexp, queryCost{Terms: 1, Candidates: 2}},
+		{"fuzzy", fuzzy, queryCost{Terms: 1, Candidates: 2}},
+		{"conjunction", bleve.NewConjunctionQuery(term("apple"), term("date")), queryCost{Terms: 2, Candidates: 1}},
+		{"disjunction", bleve.NewDisjunctionQuery(term("apricot"), term("date")), queryCost{Terms: 2, Candidates: 2}},
+		{"must and must not", mustNot, queryCost{Terms: 2, Candidates: 2}},
+		{"only must not", onlyMustNot, queryCost{Terms: 1, Candidates: 4}},
+		{"query string", bleve.NewQueryStringQuery("apple +cherry"), queryCost{Terms: 2, Candidates: 2}},
+		{"doc IDs", bleve.NewDocIDQuery([]string{"1", "3"}), queryCost{Candidates: 2}},
+		{"match all query", bleve.NewMatchAllQuery(), queryCost{Candidates: 4}},
+		{"match none", bleve.NewMatchNoneQuery(), queryCost{}},
+	}
+	for _, test := range tests {
+		got, err := estimateIndexCost(idx, test.q)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: cost = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
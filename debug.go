@@ -0,0 +1,88 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+var debugEndpoints = flag.Bool("debug", false,
+	"serve /debug/pprof and /debug/vars, behind the admin token or on -adminAddr")
+var adminAddr = flag.String("adminAddr", "",
+	"optional separate listen address of the debug endpoints, like localhost:8096; they need no token there, so keep it private")
+
+var startTime = time.Now()
+
+// debugMux serves the profiles of net/http/pprof and the expvar variables.
+// Both packages register their handlers on http.DefaultServeMux as well,
+// which is why the public server uses a mux of its own.
+func debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// startDebug publishes the runtime, GC, index and breaker variables and serves the
+// debug endpoints, on their own listener when -adminAddr is set and on the
+// public mux behind the admin token otherwise.
+func startDebug(public *http.ServeMux) {
+	if !*debugEndpoints {
+		return
+	}
+
+	expvar.Publish("runtime", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"goroutines": runtime.NumGoroutine(),
+			"cpus":       runtime.NumCPU(),
+			"gomaxprocs": runtime.GOMAXPROCS(0),
+			"version":    runtime.Version(),
+			"uptime":     time.Since(startTime).Round(time.Second).String(),
+		}
+	}))
+	expvar.Publish("gc", expvar.Func(func() interface{} {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return map[string]interface{}{
+			"numGC":         m.NumGC,
+			"pauseTotalMs":  float64(m.PauseTotalNs) / 1e6,
+			"lastPauseMs":   float64(m.PauseNs[(m.NumGC+255)%256]) / 1e6,
+			"lastGC":        time.Unix(0, int64(m.LastGC)),
+			"gcCPUFraction": m.GCCPUFraction,
+			"heapAlloc":     m.HeapAlloc,
+			"heapObjects":   m.HeapObjects,
+			"heapSys":       m.HeapSys,
+			"nextGC":        m.NextGC,
+		}
+	}))
+	expvar.Publish("indexes", expvar.Func(func() interface{} {
+		bleveStats := indexes.BleveStats()
+		res := map[string]interface{}{}
+		for _, stat := range indexes.Stats() {
+			res[stat.Name] = map[string]interface{}{
+				"manager": stat,
+				"bleve":   bleveStats[stat.Name],
+			}
+		}
+		return res
+	}))
+
+	expvar.Publish("breaker", expvar.Func(breakerState))
+
+	if *adminAddr != "" {
+		go func() {
+			log.Printf("serving debug endpoints on %v", *adminAddr)
+			log.Fatal(http.ListenAndServe(*adminAddr, debugMux()))
+		}()
+		return
+	}
+	public.HandleFunc("/debug/", adminOnly(debugMux().ServeHTTP))
+}
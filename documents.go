@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// docWrite is one change to an index, an update when doc is set and a delete
+// otherwise.
+type docWrite struct {
+	id  string
+	doc map[string]interface{}
+}
+
+// writeDocuments applies writes to the named index, or to the single index
+// behind the named alias, in one batch. Missing indexes are created with the
+// default mapping.
+func writeDocuments(indexName string, writes []docWrite) error {
+	targets := resolveIndex(indexName)
+	if len(targets) != 1 {
+		return fmt.Errorf("cannot write to alias %q of %d indexes", indexName, len(targets))
+	}
+
+	defer indexes.BeginWrite(targets[0])()
+	index, release, err := indexes.AcquireOrCreate(targets[0], bleve.NewIndexMapping())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	batch := index.NewBatch()
+	for _, w := range writes {
+		if w.doc == nil {
+			batch.Delete(w.id)
+			continue
+		}
+		if err := batch.Index(w.id, w.doc); err != nil {
+			return fmt.Errorf("document %q: %v", w.id, err)
+		}
+	}
+	return index.Batch(batch)
+}
+
+// documentsHandler serves single documents:
+//
+//	GET    /documents/{index}/{id} stored fields of a document
+//	PUT    /documents/{index}/{id} index a JSON object as the document
+//	DELETE /documents/{index}/{id} remove a document
+//
+// Writes need the admin token.
+func documentsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/documents/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "expected /documents/{index}/{id}", http.StatusNotFound)
+		return
+	}
+	indexName, id := parts[0], parts[1]
+
+	switch r.Method {
+	case http.MethodGet:
+		getDocument(w, indexName, id)
+
+	case http.MethodPut:
+		adminOnly(func(w http.ResponseWriter, r *http.Request) {
+			var doc map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&doc); err != nil || doc == nil {
+				http.Error(w, fmt.Sprintf("body must be a JSON object: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := writeDocuments(indexName, []docWrite{{id: id, doc: doc}}); err != nil {
+				log.Printf("error indexing %q into %s: %v", id, indexName, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})(w, r)
+
+	case http.MethodDelete:
+		adminOnly(func(w http.ResponseWriter, r *http.Request) {
+			if err := writeDocuments(indexName, []docWrite{{id: id}}); err != nil {
+				log.Printf("error deleting %q from %s: %v", id, indexName, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getDocument(w http.ResponseWriter, indexName string, id string) {
+	index, release, err := acquireIndex(indexName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer release()
+
+	req := bleve.NewSearchRequest(bleve.NewDocIDQuery([]string{id}))
+	req.Fields = []string{"*"}
+	res, err := index.Search(req)
+	if err != nil {
+		log.Printf("index search error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(res.Hits) == 0 {
+		http.Error(w, "document not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, res.Hits[0].Fields)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// judgments holds the graded relevance of documents for each query, grade 0
+// meaning judged not relevant
+type judgments struct {
+	queries []string // in file order
+	grades  map[string]map[string]int
+}
+
+// readJudgments reads a file of tab separated query, document ID and grade
+// lines. Blank lines and lines starting with # are skipped.
+func readJudgments(path string) (*judgments, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	j := &judgments{grades: map[string]map[string]int{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected query, document ID and grade separated by tabs", path, n)
+		}
+		grade, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+		if err != nil || grade < 0 {
+			return nil, fmt.Errorf("%s:%d: grade must be a non negative integer", path, n)
+		}
+		q := parts[0]
+		if _, ok := j.grades[q]; !ok {
+			j.queries = append(j.queries, q)
+			j.grades[q] = map[string]int{}
+		}
+		j.grades[q][parts[1]] = grade
+	}
+	return j, scanner.Err()
+}
+
+// parseEvalConfig reads a comma separated list of key=value settings, like
+// "profile=title,mode=phrase", on top of base.
+func parseEvalConfig(spec string, base searchConfig) (searchConfig, error) {
+	settings := map[string]string{}
+	for _, setting := range strings.Split(spec, ",") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return base, fmt.Errorf("expected key=value, got %q", setting)
+		}
+		settings[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return applySearchSettings(base, settings)
+}
+
+// queryMetrics are the scores of the top k hits of one query
+type queryMetrics struct {
+	Query  string
+	Hits   uint64
+	NDCG   float64
+	AP     float64
+	RR     float64
+	Recall float64
+}
+
+// evaluate runs every judged query through performSearch and scores the
+// top k hits. Queries without a single relevant document are skipped as
+// none of the metrics are defined for them.
+func evaluate(config searchConfig, j *judgments, k int) ([]queryMetrics, error) {
+	opts := config.Opts
+	opts.Size = k
+
+	var metrics []queryMetrics
+	for _, q := range j.queries {
+		grades := j.grades[q]
+		if relevantCount(grades) == 0 {
+			continue
+		}
+
+		res, err := performSearch(context.Background(), config.Index, q, opts)
+		if err != nil {
+			return nil, fmt.Errorf("query %q: %v", q, err)
+		}
+		ranked := make([]string, len(res.Hits))
+		for i, hit := range res.Hits {
+			ranked[i] = hit.ID
+		}
+		m := scoreRanking(ranked, grades, k)
+		m.Query, m.Hits = q, res.Total
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// scoreRanking scores the top k of the ranked document IDs against the
+// grades of a query with at least one relevant document
+func scoreRanking(ranked []string, grades map[string]int, k int) queryMetrics {
+	var relevant []int
+	for _, grade := range grades {
+		if grade > 0 {
+			relevant = append(relevant, grade)
+		}
+	}
+
+	var m queryMetrics
+	var dcg, precisionSum float64
+	found := 0
+	for i, id := range ranked {
+		if i >= k {
+			break
+		}
+		grade := grades[id]
+		if grade <= 0 {
+			continue
+		}
+		found++
+		dcg += gain(grade, i)
+		precisionSum += float64(found) / float64(i+1)
+		if m.RR == 0 {
+			m.RR = 1 / float64(i+1)
+		}
+	}
+
+	// the ideal ranking has the relevant documents best first
+	sort.Sort(sort.Reverse(sort.IntSlice(relevant)))
+	var idcg float64
+	for i, grade := range relevant {
+		if i >= k {
+			break
+		}
+		idcg += gain(grade, i)
+	}
+
+	m.NDCG = dcg / idcg
+	m.AP = precisionSum / float64(len(relevant))
+	m.Recall = float64(found) / float64(len(relevant))
+	return m
+}
+
+func relevantCount(grades map[string]int) int {
+	n := 0
+	for _, grade := range grades {
+		if grade > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// gain is the discounted gain of a document of the given grade at rank i,
+// counting from 0
+func gain(grade int, i int) float64 {
+	return (math.Pow(2, float64(grade)) - 1) / math.Log2(float64(i+2))
+}
+
+// evalSummary holds the means of the metrics over all queries
+type evalSummary struct {
+	NDCG, MAP, MRR, Recall float64
+}
+
+func summarize(metrics []queryMetrics) evalSummary {
+	var s evalSummary
+	if len(metrics) == 0 {
+		return s
+	}
+	for _, m := range metrics {
+		s.NDCG += m.NDCG
+		s.MAP += m.AP
+		s.MRR += m.RR
+		s.Recall += m.Recall
+	}
+	n := float64(len(metrics))
+	return evalSummary{NDCG: s.NDCG / n, MAP: s.MAP / n, MRR: s.MRR / n, Recall: s.Recall / n}
+}
+
+func (s evalSummary) values() []float64 {
+	return []float64{s.NDCG, s.MAP, s.MRR, s.Recall}
+}
+
+func metricNames(k int) []string {
+	return []string{fmt.Sprintf("nDCG@%d", k), "MAP", "MRR", fmt.Sprintf("recall@%d", k)}
+}
+
+func evalCommand(args []string) {
+	flags := flag.NewFlagSet("eval", flag.ExitOnError)
+	flags.StringVar(dataDir, "dataDir", *dataDir, "data directory")
+	flags.StringVar(rankingConfigPath, "rankingConfig", *rankingConfigPath, "optional path to the ranking profiles")
+	flags.StringVar(ltrModelPath, "ltrModel", *ltrModelPath, "optional learned ranking model, turn it off for a configuration with ltr=off")
+	flags.IntVar(ltrTopN, "ltrTopN", *ltrTopN, "number of top hits reranked by the learned ranking model")
+	flags.IntVar(priorTopN, "priorTopN", *priorTopN, "number of top hits rescored by the positional prior, should match -priorTopN of the server")
+	indexName := flags.String("index", "", "index or alias to search")
+	judgmentsPath := flags.String("judgments", "", "file of tab separated query, document ID and grade lines")
+	k := flags.Int("k", 10, "number of top hits scored per query")
+	mode := flags.String("mode", "", "search mode, match, phrase or query")
+	profile := flags.String("profile", "", "ranking profile")
+	lang := flags.String("lang", "", "language of the queries")
+	diff := flags.String("diff", "",
+		`optional second configuration to compare against, like "profile=title,mode=phrase"; unset keys (index, mode, profile, lang, ltr) are the same as the first`)
+	verbose := flags.Bool("v", false, "print the metrics of every query")
+	flags.Parse(args)
+
+	if *indexName == "" || *judgmentsPath == "" || *k <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: server eval -index <index> -judgments <file> [flags]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	indexes = newIndexManager(*dataDir, *maxOpenIndexes, *openIndexBudget)
+	// only searched, which works next to a server reading the same indexes
+	indexes.readOnly = true
+	if err := loadRankingConfig(); err != nil {
+		log.Fatalf("error loading ranking config: %v", err)
+	}
+	if err := loadLTRModel(); err != nil {
+		log.Fatalf("error loading learned ranking model: %v", err)
+	}
+	if err := loadAliases(); err != nil {
+		log.Fatalf("error loading aliases: %v", err)
+	}
+
+	j, err := readJudgments(*judgmentsPath)
+	if err != nil {
+		log.Fatalf("error reading judgments: %v", err)
+	}
+	for _, q := range j.queries {
+		if relevantCount(j.grades[q]) == 0 {
+			log.Printf("skipping query %q, it has no relevant documents", q)
+		}
+	}
+
+	base, err := parseEvalConfig("", searchConfig{Index: *indexName, Opts: searchOptions{Mode: *mode, Profile: *profile, Lang: *lang}})
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	baseMetrics, err := evaluate(base, j, *k)
+	if err != nil {
+		log.Fatalf("evaluation failed: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	if *diff == "" {
+		if *verbose {
+			fmt.Fprintf(w, "query\thits\t%s\n", strings.Join(metricNames(*k), "\t"))
+			for _, m := range baseMetrics {
+				fmt.Fprintf(w, "%s\t%d\t%.4f\t%.4f\t%.4f\t%.4f\n", m.Query, m.Hits, m.NDCG, m.AP, m.RR, m.Recall)
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s, %d queries\n", base, len(baseMetrics))
+		for i, v := range summarize(baseMetrics).values() {
+			fmt.Fprintf(w, "%s\t%.4f\n", metricNames(*k)[i], v)
+		}
+		return
+	}
+
+	other, err := parseEvalConfig(*diff, base)
+	if err != nil {
+		log.Fatalf("invalid -diff configuration: %v", err)
+	}
+	otherMetrics, err := evaluate(other, j, *k)
+	if err != nil {
+		log.Fatalf("evaluation failed: %v", err)
+	}
+
+	// both runs skip the same queries, so the metrics line up
+	type change struct {
+		query string
+		a, b  float64
+	}
+	var changes []change
+	better, worse := 0, 0
+	for i := range baseMetrics {
+		a, b := baseMetrics[i].NDCG, otherMetrics[i].NDCG
+		if math.Abs(b-a) < 1e-9 {
+			if *verbose {
+				changes = append(changes, change{baseMetrics[i].Query, a, b})
+			}
+			continue
+		}
+		if b > a {
+			better++
+		} else {
+			worse++
+		}
+		changes = append(changes, change{baseMetrics[i].Query, a, b})
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].b-changes[i].a > changes[j].b-changes[j].a })
+
+	fmt.Fprintf(w, "A: %s\nB: %s\n%d queries, B better on %d, worse on %d\n\n", base, other, len(baseMetrics), better, worse)
+	fmt.Fprintln(w, "metric\tA\tB\tdelta")
+	a, b := summarize(baseMetrics).values(), summarize(otherMetrics).values()
+	for i, name := range metricNames(*k) {
+		fmt.Fprintf(w, "%s\t%.4f\t%.4f\t%+.4f\n", name, a[i], b[i], b[i]-a[i])
+	}
+	if len(changes) > 0 {
+		fmt.Fprintf(w, "\nquery\tA nDCG@%d\tB nDCG@%d\tdelta\n", *k, *k)
+		for _, c := range changes {
+			fmt.Fprintf(w, "%s\t%.4f\t%.4f\t%+.4f\n", c.query, c.a, c.b, c.b-c.a)
+		}
+	}
+}
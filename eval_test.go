@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScoreRanking(t *testing.T) {
+	log3 := math.Log2(3)
+	tests := []struct {
+		name   string
+		ranked []string
+		grades map[string]int
+		k      int
+		want   queryMetrics
+	}{
+		{
+			name:   "ideal order",
+			ranked: []string{"a", "b", "x"},
+			grades: map[string]int{"a": 2, "b": 1, "x": 0},
+			k:      10,
+			want:   queryMetrics{NDCG: 1, AP: 1, RR: 1, Recall: 1},
+		},
+		{
+			name:   "reversed grades",
+			ranked: []string{"b", "a"},
+			grades: map[string]int{"a": 2, "b": 1},
+			k:      10,
+			want:   queryMetrics{NDCG: (1 + 3/log3) / (3 + 1/log3), AP: 1, RR: 1, Recall: 1},
+		},
+		{
+			name:   "relevant second",
+			ranked: []string{"x", "a", "y"},
+			grades: map[string]int{"a": 1, "x": 0},
+			k:      10,
+			want:   queryMetrics{NDCG: 1 / log3, AP: 0.5, RR: 0.5, Recall: 1},
+		},
+		{
+			name:   "half the relevant found third",
+			ranked: []string{"x", "y", "a"},
+			grades: map[string]int{"a": 1, "b": 1},
+			k:      10,
+			want:   queryMetrics{NDCG: 0.5 / (1 + 1/log3), AP: 1.0 / 6, RR: 1.0 / 3, Recall: 0.5},
+		},
+		{
+			name:   "relevant below k",
+			ranked: []string{"x", "a"},
+			grades: map[string]int{"a": 1},
+			k:      1,
+			want:   queryMetrics{},
+		},
+		{
+			name:   "nothing returned",
+			ranked: nil,
+			grades: map[string]int{"a": 3},
+			k:      10,
+			want:   queryMetrics{},
+		},
+	}
+	for _, test := range tests {
+		got := scoreRanking(test.ranked, test.grades, test.k)
+		for _, metric := range []struct {
+			name      string
+			got, want float64
+		}{
+			{"nDCG", got.NDCG, test.want.NDCG},
+			{"AP", got.AP, test.want.AP},
+			{"RR", got.RR, test.want.RR},
+			{"recall", got.Recall, test.want.Recall},
+		} {
+			if math.Abs(metric.got-metric.want) > 1e-9 {
+				t.Errorf("%s: %s = %v, want %v", test.name, metric.name, metric.got, metric.want)
+			}
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	s := summarize([]queryMetrics{
+		{NDCG: 1, AP: 1, RR: 1, Recall: 1},
+		{NDCG: 0.5, AP: 0.5, RR: 0.25, Recall: 0},
+	})
+	want := evalSummary{NDCG: 0.75, MAP: 0.75, MRR: 0.625, Recall: 0.5}
+	if s != want {
+		t.Errorf("summarize = %+v, want %+v", s, want)
+	}
+	if s := summarize(nil); s != (evalSummary{}) {
+		t.Errorf("summarize(nil) = %+v, want zero", s)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+)
+
+var experimentsPath = flag.String("experiments", "",
+	"optional path to a JSON file of A/B experiments splitting the searches of an index between variants of search settings")
+
+// experiment splits the searches of an index between variants
+type experiment struct {
+	Name     string              `json:"name"`
+	Index    string              `json:"index"`
+	Variants []experimentVariant `json:"variants"`
+}
+
+// experimentVariant is a set of search settings, see applySearchSettings,
+// that overrides those of the request. Weight is its share of the users
+// relative to the other variants.
+type experimentVariant struct {
+	Name     string            `json:"name"`
+	Weight   int               `json:"weight"`
+	Settings map[string]string `json:"settings"`
+}
+
+// experiments maps index names to the experiment running on them
+var experiments = map[string]*experiment{}
+
+func loadExperiments() error {
+	if *experimentsPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(*experimentsPath)
+	if err != nil {
+		return err
+	}
+	var config struct {
+		Experiments []*experiment `json:"experiments"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parsing %s: %v", *experimentsPath, err)
+	}
+
+	names := map[string]bool{}
+	for _, exp := range config.Experiments {
+		if exp.Name == "" || exp.Index == "" || len(exp.Variants) == 0 {
+			return fmt.Errorf("experiments need a name, an index and variants")
+		}
+		if names[exp.Name] {
+			return fmt.Errorf("experiment %s is defined twice", exp.Name)
+		}
+		names[exp.Name] = true
+		if other, ok := experiments[exp.Index]; ok {
+			return fmt.Errorf("experiments %s and %s both run on %s", other.Name, exp.Name, exp.Index)
+		}
+
+		variants := map[string]bool{}
+		for _, v := range exp.Variants {
+			if v.Name == "" || variants[v.Name] {
+				return fmt.Errorf("experiment %s: variants need distinct names", exp.Name)
+			}
+			variants[v.Name] = true
+			if v.Weight <= 0 {
+				return fmt.Errorf("experiment %s: variant %s needs a positive weight", exp.Name, v.Name)
+			}
+			if _, err := applySearchSettings(searchConfig{Index: exp.Index}, v.Settings); err != nil {
+				return fmt.Errorf("experiment %s: variant %s: %v", exp.Name, v.Name, err)
+			}
+		}
+		experiments[exp.Index] = exp
+	}
+	return nil
+}
+
+// maxUIDLength caps the uid clients send back
+const maxUIDLength = 64
+
+// assignVariant puts the user behind a request in a variant of the
+// experiment running on the index, if any. Users are identified by their
+// X-API-Key header or else by a uid, hashed with the experiment name so they
+// stay in the same variant. The uid comes from the uid parameter, which
+// cross origin clients like the UI send back since they don't get cookies,
+// or the uid cookie. A new one is set as the cookie and returned when there
+// is neither.
+func assignVariant(w http.ResponseWriter, r *http.Request, indexName string) (*experiment, *experimentVariant, string) {
+	exp, ok := experiments[indexName]
+	if !ok {
+		return nil, nil, ""
+	}
+
+	unit, uid := "", ""
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		unit = "key:" + key
+	} else {
+		uid = r.URL.Query().Get("uid")
+		if cookie, err := r.Cookie("uid"); uid == "" && err == nil {
+			uid = cookie.Value
+		}
+		if uid == "" || len(uid) > maxUIDLength {
+			b := make([]byte, 16)
+			rand.Read(b)
+			uid = hex.EncodeToString(b)
+			http.SetCookie(w, &http.Cookie{Name: "uid", Value: uid, Path: "/", MaxAge: 365 * 24 * 60 * 60, HttpOnly: true})
+		}
+		unit = "uid:" + uid
+	}
+
+	total := 0
+	for _, v := range exp.Variants {
+		total += v.Weight
+	}
+	sum := sha256.Sum256([]byte(exp.Name + "\x00" + unit))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for i := range exp.Variants {
+		bucket -= exp.Variants[i].Weight
+		if bucket < 0 {
+			return exp, &exp.Variants[i], uid
+		}
+	}
+	return exp, &exp.Variants[len(exp.Variants)-1], uid
+}
+
+// variantReport compares the variants of an experiment
+type variantReport struct {
+	Experiment     string
+	Variant        string
+	Searches       int
+	ZeroResults    int
+	Clicks         int
+	CTR            float64
+	ZeroResultRate float64
+}
+
+// experimentsReportHandler serves GET /admin/experiments/report, the searches,
+// clicks, click through rate and zero result rate of every variant, from the
+// query and click logs. ?experiment= limits it to one experiment.
+func experimentsReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if *queryLogPath == "" {
+		http.Error(w, "the experiments report needs the query log, see -queryLog", http.StatusConflict)
+		return
+	}
+	only := r.URL.Query().Get("experiment")
+
+	type key struct{ experiment, variant string }
+	reports := map[key]*variantReport{}
+	reportFor := func(experiment, variant string) *variantReport {
+		if experiment == "" || (only != "" && experiment != only) {
+			return nil
+		}
+		k := key{experiment, variant}
+		if reports[k] == nil {
+			reports[k] = &variantReport{Experiment: experiment, Variant: variant}
+		}
+		return reports[k]
+	}
+
+	err := readQueryLog(*queryLogPath, func(entry queryLogEntry) {
+		if report := reportFor(entry.Experiment, entry.Variant); report != nil {
+			report.Searches++
+			if entry.Hits == 0 {
+				report.ZeroResults++
+			}
+		}
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading query log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if *clickLogPath != "" {
+		err = readClickLog(*clickLogPath, func(entry clickLogEntry) {
+			if report := reportFor(entry.Experiment, entry.Variant); report != nil {
+				report.Clicks++
+			}
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reading click log: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	res := make([]variantReport, 0, len(reports))
+	for _, report := range reports {
+		if report.Searches > 0 {
+			report.CTR = float64(report.Clicks) / float64(report.Searches)
+			report.ZeroResultRate = float64(report.ZeroResults) / float64(report.Searches)
+		}
+		res = append(res, *report)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Experiment != res[j].Experiment {
+			return res[i].Experiment < res[j].Experiment
+		}
+		return res[i].Variant < res[j].Variant
+	})
+	writeJSON(w, http.StatusOK, res)
+}
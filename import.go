@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// maxReportedRowErrors caps the row errors kept in an import report
+const maxReportedRowErrors = 100
+
+// importSpec says how rows of a JSONL or CSV import map onto documents. The
+// text column is indexed as the Line field that /search highlights, metadata
+// columns are stored under their own names.
+type importSpec struct {
+	Format    string
+	ID        string
+	Text      string
+	Meta      []string
+	BatchSize int
+}
+
+type importRowError struct {
+	Row   int
+	Error string
+}
+
+type importReport struct {
+	Rows      int
+	Imported  int
+	Failed    int
+	Errors    []importRowError
+	Truncated bool `json:",omitempty"`
+}
+
+func (r *importReport) rowError(row int, err error) {
+	r.Failed++
+	if len(r.Errors) < maxReportedRowErrors {
+		r.Errors = append(r.Errors, importRowError{Row: row, Error: err.Error()})
+	} else {
+		r.Truncated = true
+	}
+}
+
+func (spec importSpec) validate() error {
+	if spec.Format != "jsonl" && spec.Format != "csv" {
+		return fmt.Errorf("unknown format %q, expected jsonl or csv", spec.Format)
+	}
+	if spec.ID == "" || spec.Text == "" {
+		return fmt.Errorf("the id and text columns are required")
+	}
+	if spec.BatchSize <= 0 {
+		return fmt.Errorf("batch size must be positive")
+	}
+	return nil
+}
+
+// importRows validates every row read from r and passes the valid ones to
+// write in batches. Invalid rows are reported and skipped, only errors that
+// stop the whole import are returned.
+func importRows(r io.Reader, spec importSpec, write func([]docWrite) error) (*importReport, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	report := &importReport{}
+	seen := map[string]int{}
+	var pending []docWrite
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := write(pending); err != nil {
+			return err
+		}
+		report.Imported += len(pending)
+		pending = pending[:0]
+		return nil
+	}
+	add := func(row int, values map[string]interface{}) error {
+		report.Rows++
+		id, doc, err := spec.document(values)
+		if err == nil {
+			if first, dup := seen[id]; dup {
+				err = fmt.Errorf("duplicate id %q, first seen in row %d", id, first)
+			}
+		}
+		if err != nil {
+			report.rowError(row, err)
+			return nil
+		}
+		seen[id] = row
+		pending = append(pending, docWrite{id: id, doc: doc})
+		if len(pending) >= spec.BatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	var err error
+	if spec.Format == "csv" {
+		err = readCSVRows(r, spec, add, report)
+	} else {
+		err = readJSONLRows(r, add, report)
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// document builds the document for one row, checking that it has the
+// required columns.
+func (spec importSpec) document(values map[string]interface{}) (string, map[string]interface{}, error) {
+	id, err := columnString(values, spec.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	if id == "" {
+		return "", nil, fmt.Errorf("empty id column %q", spec.ID)
+	}
+	text, err := columnString(values, spec.Text)
+	if err != nil {
+		return "", nil, err
+	}
+
+	doc := map[string]interface{}{"Line": text}
+	for _, column := range spec.Meta {
+		if v, ok := values[column]; ok && v != nil {
+			doc[column] = v
+		}
+	}
+	return id, doc, nil
+}
+
+func columnString(values map[string]interface{}, column string) (string, error) {
+	v, ok := values[column]
+	if !ok || v == nil {
+		return "", fmt.Errorf("missing column %q", column)
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("column %q must be a string or a number", column)
+	}
+}
+
+func readJSONLRows(r io.Reader, add func(int, map[string]interface{}) error, report *importReport) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for row := 1; scanner.Scan(); row++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var values map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		if err := dec.Decode(&values); err != nil {
+			report.Rows++
+			report.rowError(row, fmt.Errorf("invalid JSON: %v", err))
+			continue
+		}
+		if err := add(row, values); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readCSVRows reads CSV with a header row naming the columns. Rows are
+// numbered from 1 for the first row after the header.
+func readCSVRows(r io.Reader, spec importSpec, add func(int, map[string]interface{}) error, report *importReport) error {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("reading CSV header: %v", err)
+	}
+	columns := map[string]bool{}
+	for _, name := range header {
+		columns[name] = true
+	}
+	for _, name := range append([]string{spec.ID, spec.Text}, spec.Meta...) {
+		if !columns[name] {
+			return fmt.Errorf("CSV header has no column %q", name)
+		}
+	}
+
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok && parseErr.Err == csv.ErrFieldCount {
+			report.Rows++
+			report.rowError(row, fmt.Errorf("expected %d fields, got %d", len(header), len(record)))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		values := make(map[string]interface{}, len(header))
+		for i, name := range header {
+			values[name] = record[i]
+		}
+		if err := add(row, values); err != nil {
+			return err
+		}
+	}
+}
+
+func parseMetaColumns(s string) []string {
+	var columns []string
+	for _, column := range strings.Split(s, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// importCommand loads a JSONL or CSV file into an index:
+//
+//	server import -index data/notes.bleve -format csv -id id -text body -meta author,year notes.csv
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	indexPath := flags.String("index", "", "path of the index to write to, created if it doesn't exist")
+	mappingPath := flags.String("mapping", "", "optional path to a JSON index mapping used when creating the index")
+	format := flags.String("format", "jsonl", "input format, jsonl or csv")
+	idColumn := flags.String("id", "id", "column holding the document ID")
+	textColumn := flags.String("text", "text", "column holding the searchable text")
+	metaColumns := flags.String("meta", "", "comma separated columns stored as metadata")
+	batchSize := flags.Int("batchSize", 1000, "number of documents per batch")
+	flags.Parse(args)
+
+	if *indexPath == "" || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: server import -index <index path> [flags] <file>")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("error opening %s: %v", flags.Arg(0), err)
+	}
+	defer f.Close()
+
+	index, err := openOrCreateIndex(*indexPath, *mappingPath, bleve.NewIndexMapping)
+	if err != nil {
+		log.Fatalf("error opening index %s: %v", *indexPath, err)
+	}
+	defer index.Close()
+
+	spec := importSpec{
+		Format:    *format,
+		ID:        *idColumn,
+		Text:      *textColumn,
+		Meta:      parseMetaColumns(*metaColumns),
+		BatchSize: *batchSize,
+	}
+	report, err := importRows(f, spec, func(writes []docWrite) error {
+		batch := index.NewBatch()
+		for _, w := range writes {
+			if err := batch.Index(w.id, w.doc); err != nil {
+				return fmt.Errorf("document %q: %v", w.id, err)
+			}
+		}
+		return index.Batch(batch)
+	})
+	if report != nil {
+		for _, rowErr := range report.Errors {
+			fmt.Printf("row %d: %s\n", rowErr.Row, rowErr.Error)
+		}
+		if report.Truncated {
+			fmt.Printf("... only the first %d row errors are shown\n", maxReportedRowErrors)
+		}
+		fmt.Printf("rows: %d, imported: %d, failed: %d\n", report.Rows, report.Imported, report.Failed)
+	}
+	if err != nil {
+		log.Fatalf("import failed: %v", err)
+	}
+}
+
+// importHandler serves POST /admin/import/{index}. The body is the JSONL or
+// CSV data, the spec comes from the query string:
+//
+//	POST /admin/import/notes.bleve?format=csv&id=id&text=body&meta=author,year
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	indexName := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/import/"), "/")
+	if indexName == "" {
+		http.Error(w, "expected /admin/import/{index}", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	spec := importSpec{
+		Format:    query.Get("format"),
+		ID:        query.Get("id"),
+		Text:      query.Get("text"),
+		Meta:      parseMetaColumns(query.Get("meta")),
+		BatchSize: 1000,
+	}
+	if spec.Format == "" {
+		spec.Format = "jsonl"
+	}
+	if spec.ID == "" {
+		spec.ID = "id"
+	}
+	if spec.Text == "" {
+		spec.Text = "text"
+	}
+	if s := query.Get("batchSize"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "invalid batchSize", http.StatusBadRequest)
+			return
+		}
+		spec.BatchSize = n
+	}
+	if err := spec.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if targets := resolveIndex(indexName); len(targets) != 1 {
+		http.Error(w, fmt.Sprintf("cannot import into alias %q of %d indexes", indexName, len(targets)), http.StatusBadRequest)
+		return
+	}
+
+	// errors of the data are the client's, those of writing it are ours
+	var writeErr error
+	report, err := importRows(r.Body, spec, func(writes []docWrite) error {
+		writeErr = writeDocuments(indexName, writes)
+		return writeErr
+	})
+	if err != nil {
+		log.Printf("import into %s failed: %v", indexName, err)
+		status := http.StatusBadRequest
+		var busy *indexBusyError
+		if errors.As(writeErr, &busy) {
+			status = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", "1")
+		} else if writeErr != nil {
+			status = http.StatusInternalServerError
+		}
+		res := struct {
+			Error  string
+			Report *importReport `json:",omitempty"`
+		}{Error: err.Error(), Report: report}
+		writeJSON(w, status, res)
+		return
+	}
+	log.Printf("imported %d rows into %s, %d failed", report.Imported, indexName, report.Failed)
+	writeJSON(w, http.StatusOK, report)
+}
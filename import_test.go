@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportRows(t *testing.T) {
+	jsonl := importSpec{Format: "jsonl", ID: "id", Text: "body", Meta: []string{"author"}, BatchSize: 2}
+	csv := jsonl
+	csv.Format = "csv"
+
+	tests := []struct {
+		name       string
+		spec       importSpec
+		input      string
+		wantIDs    []string
+		wantFailed []int // rows reported as invalid
+		wantErr    bool
+	}{
+		{
+			name: "jsonl",
+			spec: jsonl,
+			input: `{"id":"1","body":"one","author":"a"}
+{"id":2,"body":"two"}
+not json
+{"body":"no id"}
+{"id":"","body":"empty id"}
+{"id":"1","body":"duplicate"}
+{"id":"3","body":{"not":"text"}}
+
+{"id":"4","body":"four","author":null}
+`,
+			wantIDs:    []string{"1", "2", "4"},
+			wantFailed: []int{3, 4, 5, 6, 7},
+		},
+		{
+			name: "csv",
+			spec: csv,
+			input: `id,body,author
+1,one,a
+2,two
+,empty id,b
+3,three,c
+1,duplicate,d
+`,
+			wantIDs:    []string{"1", "3"},
+			wantFailed: []int{2, 3, 5},
+		},
+		{
+			name:    "csv without a meta column",
+			spec:    csv,
+			input:   "id,body\n1,one\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			spec:    importSpec{Format: "xml", ID: "id", Text: "body", BatchSize: 1},
+			wantErr: true,
+		},
+		{
+			name:    "no text column",
+			spec:    importSpec{Format: "jsonl", ID: "id", BatchSize: 1},
+			wantErr: true,
+		},
+		{
+			name:    "no batch size",
+			spec:    importSpec{Format: "jsonl", ID: "id", Text: "body"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		var ids []string
+		var docs []map[string]interface{}
+		write := func(writes []docWrite) error {
+			if len(writes) > test.spec.BatchSize {
+				t.Errorf("%s: batch of %d, want at most %d", test.name, len(writes), test.spec.BatchSize)
+			}
+			for _, w := range writes {
+				ids = append(ids, w.id)
+				docs = append(docs, w.doc)
+			}
+			return nil
+		}
+		report, err := importRows(strings.NewReader(test.input), test.spec, write)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(ids, test.wantIDs) {
+			t.Errorf("%s: imported %q, want %q", test.name, ids, test.wantIDs)
+		}
+		var failed []int
+		for _, e := range report.Errors {
+			failed = append(failed, e.Row)
+		}
+		if !reflect.DeepEqual(failed, test.wantFailed) {
+			t.Errorf("%s: failed rows %v, want %v (%+v)", test.name, failed, test.wantFailed, report.Errors)
+		}
+		if report.Imported != len(test.wantIDs) || report.Failed != len(test.wantFailed) ||
+			report.Rows != report.Imported+report.Failed {
+			t.Errorf("%s: report %+v", test.name, report)
+		}
+		if len(docs) > 0 && (docs[0]["Line"] != "one" || docs[0]["author"] != "a") {
+			t.Errorf("%s: first document %v", test.name, docs[0])
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+	bolt "go.etcd.io/bbolt"
+)
+
+var maxOpenIndexes = flag.Int("maxOpenIndexes", 0,
+	"maximum number of indexes kept open at once, 0 for no limit")
+var openIndexBudget = flag.Int64("openIndexBudget", 0,
+	"maximum total on-disk size in bytes of the indexes kept open at once, 0 for no limit")
+
+// indexes is the manager every request goes through to get at an index
+var indexes *indexManager
+
+// boltTimeout is how long opening an index waits for the lock on its
+// root.bolt, which another process that has the index open holds
+const boltTimeout = time.Second
+
+// openExisting opens the index at path, failing instead of blocking when
+// another process, like a running server, has it open. Read only opens only
+// wait for processes writing to the index.
+func openExisting(path string, readOnly bool) (bleve.Index, error) {
+	config := map[string]interface{}{"bolt_timeout": boltTimeout.String()}
+	if readOnly {
+		config["read_only"] = true
+	}
+	index, err := bleve.OpenUsing(path, config)
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, &indexInUseError{path}
+	}
+	return index, err
+}
+
+// indexInUseError is the error of opening an index another process holds
+type indexInUseError struct {
+	path string
+}
+
+func (e *indexInUseError) Error() string {
+	return fmt.Sprintf("%s is in use by another process, like a running server", e.path)
+}
+
+// indexManager keeps recently used indexes open so that requests don't pay for
+// bleve.Open every time. When more than maxOpen indexes, or more than maxBytes
+// of index data, are open the least recently used idle index is closed. It is
+// reopened on demand by the next request that needs it.
+type indexManager struct {
+	sync.Mutex
+	dir      string
+	maxOpen  int
+	maxBytes int64
+
+	lru       *list.List // of *openIndex, most recently used first
+	resident  map[string]*list.Element
+	openBytes int64
+	stats     map[string]*indexStats
+	exclusive map[string]bool // indexes kept closed by Exclusive
+	fences    map[string]*sync.RWMutex
+	pending   map[string]chan struct{} // of indexes being opened or closed, closed once done
+
+	// readOnly opens indexes read only and never creates them
+	readOnly bool
+}
+
+// indexBusyError is the error of requests for an index that Exclusive keeps
+// closed
+type indexBusyError struct {
+	name string
+}
+
+func (e *indexBusyError) Error() string {
+	return fmt.Sprintf("index %s is busy, try again shortly", e.name)
+}
+
+type openIndex struct {
+	name  string
+	index bleve.Index
+	size  int64
+	refs  int
+}
+
+type indexStats struct {
+	Name      string
+	Resident  bool
+	SizeBytes int64
+	InUse     int
+	Hits      uint64
+	Opens     uint64
+	Evictions uint64
+	LastUsed  time.Time
+	Writes    uint64
+	LastWrite time.Time
+}
+
+func newIndexManager(dir string, maxOpen int, maxBytes int64) *indexManager {
+	return &indexManager{
+		dir:       dir,
+		maxOpen:   maxOpen,
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		resident:  map[string]*list.Element{},
+		stats:     map[string]*indexStats{},
+		exclusive: map[string]bool{},
+		fences:    map[string]*sync.RWMutex{},
+		pending:   map[string]chan struct{}{},
+	}
+}
+
+// register makes an index known to the manager without opening it.
+func (m *indexManager) register(name string) {
+	m.Lock()
+	defer m.Unlock()
+	m.statsFor(name)
+}
+
+func (m *indexManager) statsFor(name string) *indexStats {
+	s, ok := m.stats[name]
+	if !ok {
+		s = &indexStats{Name: name}
+		m.stats[name] = s
+	}
+	return s
+}
+
+func (m *indexManager) path(name string) string {
+	return m.dir + string(os.PathSeparator) + name
+}
+
+// Acquire returns the named index, opening it if it isn't resident. The
+// index stays open at least until the returned release func is called.
+func (m *indexManager) Acquire(name string) (bleve.Index, func(), error) {
+	return m.acquire(name, nil)
+}
+
+// AcquireOrCreate is like Acquire but creates the index with the given
+// mapping if it doesn't exist yet.
+func (m *indexManager) AcquireOrCreate(name string, indexMapping mapping.IndexMapping) (bleve.Index, func(), error) {
+	return m.acquire(name, indexMapping)
+}
+
+func (m *indexManager) acquire(name string, createMapping mapping.IndexMapping) (bleve.Index, func(), error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, nil, fmt.Errorf("invalid index name %q", name)
+	}
+
+	// open outside the manager lock so that requests for other indexes don't
+	// wait; requests for the same index wait for the one opening it, as two
+	// opens would fail on the bolt file lock
+	var done chan struct{}
+	for done == nil {
+		m.Lock()
+		oi, err := m.use(name)
+		if oi != nil || err != nil {
+			m.Unlock()
+			return m.acquired(oi, err)
+		}
+		if pending, ok := m.pending[name]; ok {
+			m.Unlock()
+			<-pending
+			continue
+		}
+		done = make(chan struct{})
+		m.pending[name] = done
+		m.Unlock()
+	}
+	defer func() {
+		m.Lock()
+		delete(m.pending, name)
+		close(done)
+		m.Unlock()
+	}()
+
+	index, err := openExisting(m.path(name), m.readOnly)
+	if err == bleve.ErrorIndexPathDoesNotExist && createMapping != nil && !m.readOnly {
+		log.Printf("creating index %s", name)
+		index, err = bleve.New(m.path(name), createMapping)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	index.SetName(name)
+	oi := &openIndex{name: name, index: index, size: dirSize(m.path(name)), refs: 1}
+
+	m.Lock()
+	m.resident[name] = m.lru.PushFront(oi)
+	m.openBytes += oi.size
+	m.statsFor(name).Opens++
+	m.statsFor(name).SizeBytes = oi.size
+	m.statsFor(name).LastUsed = time.Now()
+	evicted := m.evict()
+	m.Unlock()
+	m.closeRemoved(evicted)
+	return m.acquired(oi, nil)
+}
+
+// use takes a reference to the named index if it is resident. Callers hold
+// the lock.
+func (m *indexManager) use(name string) (*openIndex, error) {
+	if m.exclusive[name] {
+		return nil, &indexBusyError{name}
+	}
+	elem, ok := m.resident[name]
+	if !ok {
+		return nil, nil
+	}
+	m.lru.MoveToFront(elem)
+	oi := elem.Value.(*openIndex)
+	oi.refs++
+	m.statsFor(name).Hits++
+	m.statsFor(name).LastUsed = time.Now()
+	return oi, nil
+}
+
+// acquired returns the index of oi along with the func that releases it
+func (m *indexManager) acquired(oi *openIndex, err error) (bleve.Index, func(), error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			m.Lock()
+			oi.refs--
+			evicted := m.evict()
+			m.Unlock()
+			m.closeRemoved(evicted)
+		})
+	}
+	return oi.index, release, nil
+}
+
+func (m *indexManager) fence(name string) *sync.RWMutex {
+	m.Lock()
+	defer m.Unlock()
+	fence, ok := m.fences[name]
+	if !ok {
+		fence = &sync.RWMutex{}
+		m.fences[name] = fence
+	}
+	return fence
+}
+
+// BeginWrite is called before writing to the named index, and the returned
+// func once done. Writes run concurrently with each other but wait while
+// maintenance holds the write fence of the index.
+func (m *indexManager) BeginWrite(name string) func() {
+	fence := m.fence(name)
+	fence.RLock()
+	return func() {
+		// counted once done, so that a snapshot taken after reading the
+		// count holds every write counted
+		m.Lock()
+		m.statsFor(name).Writes++
+		m.statsFor(name).LastWrite = time.Now()
+		m.Unlock()
+		fence.RUnlock()
+	}
+}
+
+// Writes returns the number of writes to the named index since the server
+// started
+func (m *indexManager) Writes(name string) uint64 {
+	m.Lock()
+	defer m.Unlock()
+	if s, ok := m.stats[name]; ok {
+		return s.Writes
+	}
+	return 0
+}
+
+// FenceWrites waits for the writes in progress to the named index and holds
+// back new ones until the returned func is called. Searches go on.
+func (m *indexManager) FenceWrites(name string) func() {
+	fence := m.fence(name)
+	fence.Lock()
+	return fence.Unlock
+}
+
+// Exclusive closes the named index once the requests using it are done and
+// runs fn while nothing has it open. Writes to the index wait, searches fail
+// in the meantime. It gives up when the index stays in use for longer than
+// wait.
+func (m *indexManager) Exclusive(name string, wait time.Duration, fn func(path string) error) error {
+	defer m.FenceWrites(name)()
+
+	m.Lock()
+	if m.exclusive[name] {
+		m.Unlock()
+		return &indexBusyError{name}
+	}
+	m.exclusive[name] = true
+	m.Unlock()
+	defer func() {
+		m.Lock()
+		delete(m.exclusive, name)
+		m.Unlock()
+	}()
+
+	deadline := time.Now().Add(wait)
+	for {
+		m.Lock()
+		// an open in progress makes the index resident once done
+		if pending, ok := m.pending[name]; ok {
+			m.Unlock()
+			<-pending
+			continue
+		}
+		elem, ok := m.resident[name]
+		if !ok {
+			m.Unlock()
+			break
+		}
+		if elem.Value.(*openIndex).refs == 0 {
+			oi := m.remove(elem)
+			m.Unlock()
+			m.closeRemoved([]*openIndex{oi})
+			break
+		}
+		m.Unlock()
+		if time.Now().After(deadline) {
+			return fmt.Errorf("index %s is still in use after %s", name, wait)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fn(m.path(name))
+}
+
+// evict takes least recently used idle indexes out of the manager until it
+// is within its limits again, and returns them for closeRemoved. Indexes in
+// use are never evicted. Callers hold the lock.
+func (m *indexManager) evict() []*openIndex {
+	var evicted []*openIndex
+	for elem := m.lru.Back(); elem != nil && m.overBudget(); {
+		prev := elem.Prev()
+		oi := elem.Value.(*openIndex)
+		if oi.refs == 0 {
+			evicted = append(evicted, m.remove(elem))
+			m.statsFor(oi.name).Evictions++
+		}
+		elem = prev
+	}
+	return evicted
+}
+
+func (m *indexManager) overBudget() bool {
+	return (m.maxOpen > 0 && m.lru.Len() > m.maxOpen) ||
+		(m.maxBytes > 0 && m.openBytes > m.maxBytes)
+}
+
+// remove takes an index out of the manager. Until closeRemoved is done with
+// it, requests for it wait rather than open it a second time. Callers hold
+// the lock.
+func (m *indexManager) remove(elem *list.Element) *openIndex {
+	oi := elem.Value.(*openIndex)
+	m.lru.Remove(elem)
+	delete(m.resident, oi.name)
+	m.openBytes -= oi.size
+	m.pending[oi.name] = make(chan struct{})
+	return oi
+}
+
+// closeRemoved closes indexes taken out by remove, without the lock held.
+func (m *indexManager) closeRemoved(removed []*openIndex) {
+	for _, oi := range removed {
+		if err := oi.index.Close(); err != nil {
+			log.Printf("close index error: %v", err)
+		}
+		m.Lock()
+		close(m.pending[oi.name])
+		delete(m.pending, oi.name)
+		m.Unlock()
+	}
+}
+
+// Stats returns residency stats for every index the manager knows about.
+func (m *indexManager) Stats() []indexStats {
+	m.Lock()
+	defer m.Unlock()
+
+	res := make([]indexStats, 0, len(m.stats))
+	for name, s := range m.stats {
+		stat := *s
+		if elem, ok := m.resident[name]; ok {
+			stat.Resident = true
+			stat.InUse = elem.Value.(*openIndex).refs
+		}
+		res = append(res, stat)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// BleveStats returns the stats bleve keeps of each resident index, like
+// search counts and times, and those of its segments.
+func (m *indexManager) BleveStats() map[string]map[string]interface{} {
+	m.Lock()
+	defer m.Unlock()
+
+	res := make(map[string]map[string]interface{}, len(m.resident))
+	for name, elem := range m.resident {
+		res[name] = elem.Value.(*openIndex).index.StatsMap()
+	}
+	return res
+}
+
+func indexesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := indexes.Stats()
+	res := struct {
+		Open      int
+		OpenBytes int64
+		MaxOpen   int
+		MaxBytes  int64
+		Indexes   []indexStats
+		// lag behind the primary, on replicas
+		Replication []replicaStatus `json:",omitempty"`
+		// limits, rejections and whether memory tripped it
+		Breaker interface{}
+	}{
+		MaxOpen:     indexes.maxOpen,
+		MaxBytes:    indexes.maxBytes,
+		Indexes:     stats,
+		Replication: replicationStatus(),
+		Breaker:     breakerState(),
+	}
+	for _, s := range stats {
+		if s.Resident {
+			res.Open++
+			res.OpenBytes += s.SizeBytes
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// TestIndexManagerConcurrentAcquire opens, evicts and reopens indexes from
+// many goroutines at once, with one of them taken exclusively now and then.
+func TestIndexManagerConcurrentAcquire(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"a.bleve", "b.bleve", "c.bleve"}
+	for i, name := range names {
+		index, err := bleve.New(filepath.Join(dir, name), bleve.NewIndexMapping())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n <= i; n++ {
+			if err := index.Index(fmt.Sprint(n), map[string]interface{}{"Line": "line"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		index.Close()
+	}
+
+	m := newIndexManager(dir, 1, 0)
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				n := (g + i) % len(names)
+				index, release, err := m.Acquire(names[n])
+				var busy *indexBusyError
+				if errors.As(err, &busy) {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				count, err := index.DocCount()
+				release()
+				if err != nil || count != uint64(n+1) {
+					errs <- fmt.Errorf("%s has %d documents, %v", names[n], count, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			err := m.Exclusive(names[0], 5*time.Second, func(path string) error { return nil })
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for _, s := range m.Stats() {
+		if s.InUse != 0 {
+			t.Errorf("%s still has %d references", s.Name, s.InUse)
+		}
+	}
+	if open := m.lru.Len(); open > 1 {
+		t.Errorf("%d indexes open, want at most 1", open)
+	}
+}
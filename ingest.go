@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+)
+
+// ingestSource is one unit of work for the ingestion pipeline, usually a file.
+// read calls emit once per document in the source.
+type ingestSource struct {
+	name string
+	size int64
+	read func(emit func(id string, doc map[string]interface{}) error) error
+}
+
+type ingestStats struct {
+	sources      uint64
+	docs         uint64
+	bytes        uint64
+	batches      uint64
+	errors       uint64
+	totalSources uint64
+	totalBytes   uint64
+	elapsed      time.Duration
+}
+
+// ingestCommand builds an index from a directory of text files, one document
+// per line with IDs of the form "<file name>: <line number>", the same layout
+// as the hpotter.bleve index:
+//
+//	server ingest -index data/books.bleve -src books/
+//
+// Files are parsed by a pool of workers into batches that a second pool
+// writes to the index. The queue between them is bounded, so parsing slows
+// down to the pace of indexing instead of buffering the whole corpus.
+func ingestCommand(args []string) {
+	flags := flag.NewFlagSet("ingest", flag.ExitOnError)
+	indexPath := flags.String("index", "", "path of the index to write to, created if it doesn't exist")
+	srcDir := flags.String("src", "", "directory of files to index")
+	mappingPath := flags.String("mapping", "", "optional path to a JSON index mapping used when creating the index")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of parsing workers and of indexing workers")
+	batchSize := flags.Int("batchSize", 1000, "number of documents per batch")
+	queue := flags.Int("queue", 0, "number of batches waiting to be indexed before parsing blocks, defaults to 2 per worker")
+	progress := flags.Duration("progress", 5*time.Second, "interval between progress reports, 0 to disable")
+	synthetic := flags.Int("synthetic", 0, "index this many generated documents instead of -src, for benchmarking")
+	profileName := flags.String("profile", "lines", "how files are turned into documents, lines, code or mail")
+	detectLang := flags.Bool("detectLang", false,
+		"detect the language of every document and analyze it with the analyzer for that language")
+	lang := flags.String("lang", "", "language of every document, analyzed with the analyzer for that language")
+	alignLang := flags.String("alignLang", "",
+		"language of the edition the documents are aligned with, needs -lang or -detectLang")
+	alignFile := flags.String("alignFile", "",
+		"file of tab separated pairs of a document ID and the ID of its counterpart in the -alignLang edition")
+	alignWith := flags.String("alignWith", "",
+		"source directory of the -alignLang edition, to align documents with the same line of the paired file")
+	flags.Parse(args)
+
+	profile, ok := ingestProfiles[*profileName]
+	if !ok {
+		log.Fatalf("unknown ingest profile %q", *profileName)
+	}
+
+	if *indexPath == "" || (*srcDir == "" && *synthetic == 0) || *workers <= 0 || *batchSize <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *queue <= 0 {
+		*queue = 2 * *workers
+	}
+
+	var sources []ingestSource
+	var err error
+	if *synthetic > 0 {
+		sources = syntheticSources(*synthetic)
+	} else {
+		sources, err = profile.sources(*srcDir)
+		if err != nil {
+			log.Fatalf("error reading %s: %v", *srcDir, err)
+		}
+	}
+
+	if *lang != "" && !supportedLanguage(*lang) {
+		log.Fatalf("unsupported language %q", *lang)
+	}
+	if *alignLang != "" {
+		// alignHits looks counterparts up by their language tag, and the
+		// aligned fields are only mapped as whole IDs alongside it
+		if !*detectLang && *lang == "" {
+			log.Fatalf("-alignLang needs -lang or -detectLang")
+		}
+		switch {
+		case *alignFile != "":
+			alignments, err := readAlignments(*alignFile)
+			if err != nil {
+				log.Fatalf("error reading alignments: %v", err)
+			}
+			sources = withAlignments(sources, *alignLang, alignments)
+		case *alignWith != "" && *profileName == "lines":
+			sources, err = withPositionalAlignments(sources, *alignLang, *alignWith)
+			if err != nil {
+				log.Fatalf("error reading %s: %v", *alignWith, err)
+			}
+		default:
+			log.Fatalf("-alignLang needs -alignFile, or -alignWith with the lines profile")
+		}
+	}
+
+	defaultMapping := profile.mapping
+	if *detectLang || *lang != "" {
+		sources = withLanguage(sources, *lang)
+		defaultMapping = func() *mapping.IndexMappingImpl {
+			return addLanguageMappings(profile.mapping())
+		}
+	}
+
+	index, err := openOrCreateIndex(*indexPath, *mappingPath, defaultMapping)
+	if err != nil {
+		log.Fatalf("error opening index %s: %v", *indexPath, err)
+	}
+	defer index.Close()
+
+	stats := runIngest(index, sources, *workers, *batchSize, *queue, *progress)
+	printIngestSummary(index, stats)
+}
+
+// runIngest feeds sources through the parse and index worker pools and
+// returns once every document has been written.
+func runIngest(index bleve.Index, sources []ingestSource, workers, batchSize, queue int,
+	progress time.Duration) *ingestStats {
+	stats := &ingestStats{totalSources: uint64(len(sources))}
+	for _, source := range sources {
+		stats.totalBytes += uint64(source.size)
+	}
+
+	sourceCh := make(chan ingestSource)
+	batchCh := make(chan *bleve.Batch, queue)
+
+	var parsers sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		parsers.Add(1)
+		go func() {
+			defer parsers.Done()
+			for source := range sourceCh {
+				batch := index.NewBatch()
+				err := source.read(func(id string, doc map[string]interface{}) error {
+					if err := batch.Index(id, doc); err != nil {
+						atomic.AddUint64(&stats.errors, 1)
+						log.Printf("error mapping document %q: %v", id, err)
+						return nil
+					}
+					if batch.Size() >= batchSize {
+						batchCh <- batch
+						batch = index.NewBatch()
+					}
+					return nil
+				})
+				var skipped *skippedMessagesError
+				if errors.As(err, &skipped) {
+					atomic.AddUint64(&stats.errors, uint64(skipped.skipped))
+					log.Printf("error reading %v", err)
+				} else if err != nil {
+					atomic.AddUint64(&stats.errors, 1)
+					log.Printf("error reading %s: %v", source.name, err)
+				}
+				if batch.Size() > 0 {
+					batchCh <- batch
+				}
+				atomic.AddUint64(&stats.sources, 1)
+				atomic.AddUint64(&stats.bytes, uint64(source.size))
+			}
+		}()
+	}
+
+	var indexers sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		indexers.Add(1)
+		go func() {
+			defer indexers.Done()
+			for batch := range batchCh {
+				size := batch.Size()
+				if err := index.Batch(batch); err != nil {
+					atomic.AddUint64(&stats.errors, 1)
+					log.Printf("error indexing batch: %v", err)
+					continue
+				}
+				atomic.AddUint64(&stats.docs, uint64(size))
+				atomic.AddUint64(&stats.batches, 1)
+			}
+		}()
+	}
+
+	start := time.Now()
+	stop := make(chan struct{})
+	if progress > 0 {
+		go func() {
+			ticker := time.NewTicker(progress)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					logIngestProgress(stats, time.Since(start))
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	for _, source := range sources {
+		sourceCh <- source
+	}
+	close(sourceCh)
+	parsers.Wait()
+	close(batchCh)
+	indexers.Wait()
+	close(stop)
+
+	stats.elapsed = time.Since(start)
+	return stats
+}
+
+func logIngestProgress(stats *ingestStats, elapsed time.Duration) {
+	docs := atomic.LoadUint64(&stats.docs)
+	done := atomic.LoadUint64(&stats.bytes)
+	eta := "unknown"
+	if done > 0 {
+		remaining := time.Duration(float64(elapsed) * float64(stats.totalBytes-done) / float64(done))
+		eta = remaining.Round(time.Second).String()
+	}
+	log.Printf("indexed %d docs from %d/%d sources, %.0f docs/sec, ETA %s",
+		docs, atomic.LoadUint64(&stats.sources), stats.totalSources,
+		float64(docs)/elapsed.Seconds(), eta)
+}
+
+func printIngestSummary(index bleve.Index, stats *ingestStats) {
+	count, err := index.DocCount()
+	if err != nil {
+		log.Printf("error counting documents: %v", err)
+	}
+	fmt.Printf("sources:     %d\n", stats.sources)
+	fmt.Printf("documents:   %d\n", stats.docs)
+	fmt.Printf("bytes:       %d\n", stats.bytes)
+	fmt.Printf("batches:     %d\n", stats.batches)
+	fmt.Printf("errors:      %d\n", stats.errors)
+	fmt.Printf("elapsed:     %s\n", stats.elapsed.Round(time.Millisecond))
+	fmt.Printf("docs/sec:    %.0f\n", float64(stats.docs)/stats.elapsed.Seconds())
+	fmt.Printf("index docs:  %d\n", count)
+}
+
+// ingestProfile is a way of turning a directory of files into documents,
+// along with the mapping new indexes get for them
+type ingestProfile struct {
+	sources func(dir string) ([]ingestSource, error)
+	mapping func() *mapping.IndexMappingImpl
+}
+
+var ingestProfiles = map[string]ingestProfile{
+	"lines": {sources: lineSources, mapping: bleve.NewIndexMapping},
+	"code":  {sources: codeSources, mapping: codeIndexMapping},
+	"mail":  {sources: mailSources, mapping: mailIndexMapping},
+}
+
+// openOrCreateIndex opens the index at path, or creates it with the mapping
+// read from mappingPath, or the default mapping when mappingPath is empty.
+func openOrCreateIndex(path string, mappingPath string,
+	defaultMapping func() *mapping.IndexMappingImpl) (bleve.Index, error) {
+	if _, err := os.Stat(path); err == nil {
+		return openExisting(path, false)
+	}
+	if mappingPath == "" {
+		return bleve.New(path, defaultMapping())
+	}
+	indexMapping, err := loadMapping(mappingPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bleve.New(path, indexMapping)
+}
+
+// lineSources returns a source per regular file under dir that indexes every
+// line of the file as a document with a Line field.
+func lineSources(dir string) ([]ingestSource, error) {
+	var sources []ingestSource
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		sources = append(sources, ingestSource{
+			name: path,
+			size: info.Size(),
+			read: func(emit func(string, map[string]interface{}) error) error {
+				return readLineDocs(path, func(n int) string { return lineDocID(path, n) }, emit)
+			},
+		})
+		return nil
+	})
+	sort.Slice(sources, func(i, j int) bool { return sources[i].name < sources[j].name })
+	return sources, err
+}
+
+// lineDocID is the ID of the document for line n of the named file
+func lineDocID(path string, n int) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return fmt.Sprintf("%s: %d", name, n)
+}
+
+func readLineDocs(path string, docID func(n int) string, emit func(string, map[string]interface{}) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		doc := map[string]interface{}{"Line": scanner.Text()}
+		if err := emit(docID(n), doc); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// syntheticSources generates a corpus of n line documents with a Zipf-like
+// word distribution, split into sources of 10000 lines each.
+func syntheticSources(n int) []ingestSource {
+	const linesPerSource = 10000
+	const avgLineBytes = 60
+
+	vocab := make([]string, 5000)
+	for i := range vocab {
+		vocab[i] = syntheticWord(rand.New(rand.NewSource(int64(i))))
+	}
+
+	var sources []ingestSource
+	for first := 0; first < n; first += linesPerSource {
+		first := first
+		last := first + linesPerSource
+		if last > n {
+			last = n
+		}
+		name := fmt.Sprintf("synthetic %d", len(sources)+1)
+		sources = append(sources, ingestSource{
+			name: name,
+			size: int64(last-first) * avgLineBytes,
+			read: func(emit func(string, map[string]interface{}) error) error {
+				rnd := rand.New(rand.NewSource(int64(first)))
+				zipf := rand.NewZipf(rnd, 1.1, 1, uint64(len(vocab)-1))
+				for i := first; i < last; i++ {
+					words := make([]string, 4+rnd.Intn(12))
+					for w := range words {
+						words[w] = vocab[zipf.Uint64()]
+					}
+					doc := map[string]interface{}{"Line": strings.Join(words, " ")}
+					if err := emit(fmt.Sprintf("%s: %d", name, i-first+1), doc); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		})
+	}
+	return sources
+}
+
+func syntheticWord(rnd *rand.Rand) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	word := make([]byte, 2+rnd.Intn(8))
+	for i := range word {
+		word[i] = letters[rnd.Intn(len(letters))]
+	}
+	return string(word)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// BenchmarkRunIngest indexes a generated corpus with a few batch sizes and
+// worker counts:
+//
+//	go test -run '^$' -bench RunIngest -benchtime 3x
+func BenchmarkRunIngest(b *testing.B) {
+	const docs = 20000
+	sources := syntheticSources(docs)
+
+	for _, batchSize := range []int{100, 1000, 5000} {
+		for _, workers := range []int{1, 2, 4} {
+			b.Run(fmt.Sprintf("batch=%d/workers=%d", batchSize, workers), func(b *testing.B) {
+				var indexed uint64
+				var elapsed time.Duration
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					index, err := bleve.New(filepath.Join(b.TempDir(), "bench.bleve"), bleve.NewIndexMapping())
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.StartTimer()
+
+					stats := runIngest(index, sources, workers, batchSize, 2*workers, 0)
+
+					b.StopTimer()
+					if stats.errors > 0 || stats.docs != docs {
+						b.Fatalf("indexed %d of %d documents with %d errors", stats.docs, docs, stats.errors)
+					}
+					indexed += stats.docs
+					elapsed += stats.elapsed
+					index.Close()
+					b.StartTimer()
+				}
+				b.ReportMetric(float64(indexed)/elapsed.Seconds(), "docs/s")
+			})
+		}
+	}
+}
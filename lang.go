@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/analysis/lang/ar"
+	"github.com/blevesearch/bleve/v2/analysis/lang/cjk"
+	"github.com/blevesearch/bleve/v2/analysis/lang/da"
+	"github.com/blevesearch/bleve/v2/analysis/lang/de"
+	"github.com/blevesearch/bleve/v2/analysis/lang/en"
+	"github.com/blevesearch/bleve/v2/analysis/lang/es"
+	"github.com/blevesearch/bleve/v2/analysis/lang/fa"
+	"github.com/blevesearch/bleve/v2/analysis/lang/fi"
+	"github.com/blevesearch/bleve/v2/analysis/lang/fr"
+	"github.com/blevesearch/bleve/v2/analysis/lang/hi"
+	"github.com/blevesearch/bleve/v2/analysis/lang/hu"
+	"github.com/blevesearch/bleve/v2/analysis/lang/it"
+	"github.com/blevesearch/bleve/v2/analysis/lang/nl"
+	"github.com/blevesearch/bleve/v2/analysis/lang/no"
+	"github.com/blevesearch/bleve/v2/analysis/lang/pt"
+	"github.com/blevesearch/bleve/v2/analysis/lang/ro"
+	"github.com/blevesearch/bleve/v2/analysis/lang/ru"
+	"github.com/blevesearch/bleve/v2/analysis/lang/sv"
+	"github.com/blevesearch/bleve/v2/analysis/lang/tr"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// languageField is the field holding the detected language of a document
+const languageField = "language"
+
+// stopWords holds the stop words of every language that bleve has an
+// analyzer for, keyed by the analyzer name. They double as the language
+// profiles detection is based on.
+var stopWords = map[string]map[string]bool{
+	ar.AnalyzerName: parseStopWords(ar.ArabicStopWords),
+	da.AnalyzerName: parseStopWords(da.DanishStopWords),
+	de.AnalyzerName: parseStopWords(de.GermanStopWords),
+	en.AnalyzerName: parseStopWords(en.EnglishStopWords),
+	es.AnalyzerName: parseStopWords(es.SpanishStopWords),
+	fa.AnalyzerName: parseStopWords(fa.PersianStopWords),
+	fi.AnalyzerName: parseStopWords(fi.FinnishStopWords),
+	fr.AnalyzerName: parseStopWords(fr.FrenchStopWords),
+	hi.AnalyzerName: parseStopWords(hi.HindiStopWords),
+	hu.AnalyzerName: parseStopWords(hu.HungarianStopWords),
+	it.AnalyzerName: parseStopWords(it.ItalianStopWords),
+	nl.AnalyzerName: parseStopWords(nl.DutchStopWords),
+	no.AnalyzerName: parseStopWords(no.NorwegianStopWords),
+	pt.AnalyzerName: parseStopWords(pt.PortugueseStopWords),
+	ro.AnalyzerName: parseStopWords(ro.RomanianStopWords),
+	ru.AnalyzerName: parseStopWords(ru.RussianStopWords),
+	sv.AnalyzerName: parseStopWords(sv.SwedishStopWords),
+	tr.AnalyzerName: parseStopWords(tr.TurkishStopWords),
+}
+
+// parseStopWords reads the snowball and Lucene stop word list formats, where
+// "|" and "#" start comments.
+func parseStopWords(data []byte) map[string]bool {
+	words := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexAny(line, "|#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, word := range strings.Fields(line) {
+			words[strings.ToLower(word)] = true
+		}
+	}
+	return words
+}
+
+// supportedLanguage reports whether lang names a language analyzer.
+func supportedLanguage(lang string) bool {
+	_, ok := stopWords[lang]
+	return ok || lang == cjk.AnalyzerName
+}
+
+// detectTextLanguage guesses the language of text from the share of its words
+// that are stop words of each language. Chinese, Japanese and Korean are told
+// apart by script instead. confident is false when the text is too short or
+// too ambiguous for the guess to be worth acting on.
+func detectTextLanguage(text string, minHits int) (lang string, confident bool) {
+	var words []string
+	cjkRunes, letters := 0, 0
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	}) {
+		words = append(words, strings.Trim(word, "'"))
+		for _, r := range word {
+			letters++
+			if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+				cjkRunes++
+			}
+		}
+	}
+	if letters > 0 && cjkRunes*2 > letters {
+		return cjk.AnalyzerName, true
+	}
+
+	type candidate struct {
+		lang string
+		hits int
+	}
+	candidates := make([]candidate, 0, len(stopWords))
+	for lang, stops := range stopWords {
+		c := candidate{lang: lang}
+		for _, word := range words {
+			if stops[word] {
+				c.hits++
+			}
+		}
+		candidates = append(candidates, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].hits != candidates[j].hits {
+			return candidates[i].hits > candidates[j].hits
+		}
+		return candidates[i].lang < candidates[j].lang
+	})
+	best, second := candidates[0], candidates[1]
+	return best.lang, best.hits >= minHits && best.hits > second.hits
+}
+
+// withLanguage tags the documents of sources with their language, either the
+// given one or the one detected from their Line text, and sets the bleve
+// type so that they are analyzed with the mapping for that language.
+func withLanguage(sources []ingestSource, lang string) []ingestSource {
+	wrapped := make([]ingestSource, len(sources))
+	for i, source := range sources {
+		read := source.read
+		source.read = func(emit func(string, map[string]interface{}) error) error {
+			return read(func(id string, doc map[string]interface{}) error {
+				docLang := lang
+				if docLang == "" {
+					text, _ := doc["Line"].(string)
+					if detected, ok := detectTextLanguage(text, 2); ok {
+						docLang = detected
+					}
+				}
+				if docLang != "" {
+					doc[languageField] = docLang
+					doc["_type"] = docLang
+				}
+				return emit(id, doc)
+			})
+		}
+		wrapped[i] = source
+	}
+	return wrapped
+}
+
+// addLanguageMappings adds a document type per supported language to an
+// index mapping. Each is a copy of the default mapping that analyzes text
+// with the analyzer of its language, so documents tagged by withLanguage get
+// stemmed and stop word filtered for their language.
+func addLanguageMappings(indexMapping *mapping.IndexMappingImpl) *mapping.IndexMappingImpl {
+	keywordField := bleve.NewTextFieldMapping()
+	keywordField.Analyzer = keyword.Name
+	indexMapping.DefaultMapping.AddFieldMappingsAt(languageField, keywordField)
+
+	// cross references to the other editions are matched as whole IDs
+	alignedMapping := bleve.NewDocumentMapping()
+	alignedMapping.DefaultAnalyzer = keyword.Name
+	indexMapping.DefaultMapping.AddSubDocumentMapping(alignedField, alignedMapping)
+
+	defaultJSON, err := json.Marshal(indexMapping.DefaultMapping)
+	if err != nil {
+		panic(err)
+	}
+	langs := []string{cjk.AnalyzerName}
+	for lang := range stopWords {
+		langs = append(langs, lang)
+	}
+	for _, lang := range langs {
+		docMapping := bleve.NewDocumentMapping()
+		if err := json.Unmarshal(defaultJSON, docMapping); err != nil {
+			panic(err)
+		}
+		docMapping.DefaultAnalyzer = lang
+		indexMapping.AddDocumentMapping(lang, docMapping)
+	}
+	return indexMapping
+}
+
+// indexLanguages returns the languages of the documents in an index, none
+// for indexes built without language tagging.
+func indexLanguages(index bleve.Index) []string {
+	dict, err := index.FieldDict(languageField)
+	if err != nil {
+		return nil
+	}
+	defer dict.Close()
+
+	var langs []string
+	for {
+		entry, err := dict.Next()
+		if err != nil || entry == nil {
+			return langs
+		}
+		langs = append(langs, entry.Term)
+	}
+}
+
+// languageFilter restricts q to documents in lang.
+func languageFilter(q query.Query, lang string) query.Query {
+	langQuery := bleve.NewTermQuery(lang)
+	langQuery.SetField(languageField)
+	return bleve.NewConjunctionQuery(q, langQuery)
+}
+
+// withoutLanguage restricts q to documents tagged with none of langs, the
+// ones detection wasn't confident about.
+func withoutLanguage(q query.Query, langs []string) query.Query {
+	tagged := make([]query.Query, len(langs))
+	for i, lang := range langs {
+		langQuery := bleve.NewTermQuery(lang)
+		langQuery.SetField(languageField)
+		tagged[i] = langQuery
+	}
+	untagged := bleve.NewBooleanQuery()
+	untagged.AddMust(q)
+	untagged.AddMustNot(tagged...)
+	return untagged
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestDetectTextLanguage(t *testing.T) {
+	tests := []struct {
+		text          string
+		minHits       int
+		wantLang      string
+		wantConfident bool
+	}{
+		{"The cat is sitting on the table and it is happy", 2, "en", true},
+		{"Le chat est assis sur la table et il est content", 2, "fr", true},
+		{"Der Hund ist in dem Haus und er ist sehr müde", 2, "de", true},
+		{"El perro está en la casa y es muy feliz con sus amigos", 2, "es", true},
+		{"Il gatto è sulla tavola e non ha fame", 2, "it", true},
+		{"これは日本語の文です", 2, "cjk", true},
+		{"Harry Potter Nimbus", 2, "", false},
+		{"the Nimbus", 2, "", false},
+		{"the Nimbus", 1, "en", true},
+		{"", 1, "", false},
+	}
+	for _, test := range tests {
+		lang, confident := detectTextLanguage(test.text, test.minHits)
+		if confident != test.wantConfident || (confident && lang != test.wantLang) {
+			t.Errorf("detectTextLanguage(%q, %d) = %q, %v, want %q, %v",
+				test.text, test.minHits, lang, confident, test.wantLang, test.wantConfident)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// loadQuery is one search sent by the load test
+type loadQuery struct {
+	index string
+	q     string
+}
+
+// replayQueries returns a generator cycling through the queries of a query
+// log, in order, keeping those of indexName only when it is set.
+func replayQueries(path string, indexName string) (func() loadQuery, error) {
+	var queries []loadQuery
+	err := readQueryLog(path, func(entry queryLogEntry) {
+		if entry.Query != "" && (indexName == "" || entry.Index == indexName) {
+			queries = append(queries, loadQuery{index: entry.Index, q: entry.Query})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no queries to replay in %s", path)
+	}
+
+	var mu sync.Mutex
+	next := 0
+	return func() loadQuery {
+		mu.Lock()
+		defer mu.Unlock()
+		q := queries[next]
+		next = (next + 1) % len(queries)
+		return q
+	}, nil
+}
+
+// maxSyntheticTerms caps the vocabulary synthetic queries are drawn from
+const maxSyntheticTerms = 50000
+
+// termCount is a term of a field with the number of documents it is in
+type termCount struct {
+	Term  string
+	Count uint64
+}
+
+// topTerms returns the limit most frequent terms of field, most frequent
+// first
+func topTerms(index bleve.Index, field string, limit int) ([]termCount, error) {
+	dict, err := index.FieldDict(field)
+	if err != nil {
+		return nil, err
+	}
+	defer dict.Close()
+	var terms []termCount
+	for {
+		entry, err := dict.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		terms = append(terms, termCount{entry.Term, entry.Count})
+	}
+	sort.Slice(terms, func(i, j int) bool { return terms[i].Count > terms[j].Count })
+	if len(terms) > limit {
+		terms = terms[:limit]
+	}
+	return terms, nil
+}
+
+// termsHandler serves GET /admin/terms/{index}?field=Line&limit=50000, the
+// most frequent terms of a field with their document counts, which load
+// tests with synthetic queries draw from.
+func termsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/admin/terms/")
+	if name == "" || strings.Contains(name, "/") {
+		http.Error(w, "expected /admin/terms/{index}", http.StatusNotFound)
+		return
+	}
+	field := r.URL.Query().Get("field")
+	if field == "" {
+		field = "Line"
+	}
+	limit := maxSyntheticTerms
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	index, release, err := acquireIndex(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer release()
+	terms, err := topTerms(index, field, limit)
+	if err != nil {
+		log.Printf("error reading the terms of %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, terms)
+}
+
+// syntheticQueries returns a generator of queries of one to three terms of
+// field, drawn with the frequency of the terms in the index. The terms come
+// from GET /admin/terms/{index} of the server under test, which needs its
+// admin token.
+func syntheticQueries(target string, token string, indexName string, field string) (func() loadQuery, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(target, "/")+"/admin/terms/"+url.PathEscape(indexName)+
+		"?field="+url.QueryEscape(field)+"&limit="+strconv.Itoa(maxSyntheticTerms), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("reading the terms of %s: %s %s", indexName, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var terms []termCount
+	if err := json.NewDecoder(resp.Body).Decode(&terms); err != nil {
+		return nil, fmt.Errorf("reading the terms of %s: %v", indexName, err)
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("field %s of %s has no terms", field, indexName)
+	}
+
+	cumulative := make([]uint64, len(terms))
+	var total uint64
+	for i, t := range terms {
+		total += t.Count
+		cumulative[i] = total
+	}
+
+	var mu sync.Mutex
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return func() loadQuery {
+		mu.Lock()
+		defer mu.Unlock()
+		// mostly one or two terms, like real queries
+		n := 1
+		switch r := rnd.Float64(); {
+		case r > 0.85:
+			n = 3
+		case r > 0.5:
+			n = 2
+		}
+		words := make([]string, n)
+		for i := range words {
+			pick := uint64(rnd.Int63n(int64(total)))
+			words[i] = terms[sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > pick })].Term
+		}
+		return loadQuery{index: indexName, q: strings.Join(words, " ")}
+	}, nil
+}
+
+// loadResult is the outcome of one search of the load test
+type loadResult struct {
+	latency time.Duration
+	failure string // empty on success
+}
+
+func loadtestCommand(args []string) {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := flags.String("url", "http://localhost:8095", "base URL of the server under test")
+	token := flags.String("adminToken", "", "admin token of the server under test, which synthetic queries read the terms of -index from")
+	replayPath := flags.String("queryLog", "", "query log to replay")
+	synthetic := flags.Bool("synthetic", false, "generate queries from the term distribution of -index instead of replaying a query log")
+	indexName := flags.String("index", "", "index synthetic queries search, and the only index replayed from the query log when set")
+	field := flags.String("field", "Line", "field the terms of synthetic queries come from")
+	qps := flags.Float64("qps", 50, "target queries per second, 0 sends them back to back")
+	concurrency := flags.Int("concurrency", 16, "maximum number of queries in flight")
+	duration := flags.Duration("duration", 30*time.Second, "how long to send queries for")
+	timeout := flags.Duration("timeout", 10*time.Second, "timeout of each query")
+	progress := flags.Duration("progress", 5*time.Second, "interval between progress lines, 0 for none")
+	flags.Parse(args)
+
+	if (*replayPath == "") == !*synthetic || (*synthetic && (*indexName == "" || *token == "")) || *concurrency <= 0 || *qps < 0 {
+		fmt.Fprintln(os.Stderr, "usage: server loadtest (-queryLog <file> | -synthetic -index <index> -adminToken <token>) [flags]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var next func() loadQuery
+	var err error
+	if *synthetic {
+		next, err = syntheticQueries(*target, *token, *indexName, *field)
+	} else {
+		next, err = replayQueries(*replayPath, *indexName)
+	}
+	if err != nil {
+		log.Fatalf("error preparing queries: %v", err)
+	}
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+	search := func(q loadQuery) string {
+		resp, err := client.Get(*target + "/search?i=" + url.QueryEscape(q.index) + "&q=" + url.QueryEscape(q.q))
+		if err != nil {
+			return "transport error"
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+		if resp.StatusCode/100 != 2 {
+			return fmt.Sprintf("status %d", resp.StatusCode)
+		}
+		return ""
+	}
+
+	results := make(chan loadResult, *concurrency)
+	var latencies []time.Duration
+	failures := map[string]int{}
+	collected := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(collected)
+		var ticks <-chan time.Time
+		if *progress > 0 {
+			ticker := time.NewTicker(*progress)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+		lastCount, lastTime := 0, start
+		for {
+			select {
+			case res, ok := <-results:
+				if !ok {
+					return
+				}
+				latencies = append(latencies, res.latency)
+				if res.failure != "" {
+					failures[res.failure]++
+				}
+			case now := <-ticks:
+				log.Printf("sent %d queries, %.1f queries/sec", len(latencies),
+					float64(len(latencies)-lastCount)/now.Sub(lastTime).Seconds())
+				lastCount, lastTime = len(latencies), now
+			}
+		}
+	}()
+
+	// queries are sent on a fixed schedule and their latency counts from
+	// when they were due, so a server that falls behind shows up in the
+	// latencies rather than just in a lower rate
+	var wg sync.WaitGroup
+	inFlight := make(chan struct{}, *concurrency)
+	deadline := start.Add(*duration)
+	for i := 0; ; i++ {
+		due := time.Now()
+		if *qps > 0 {
+			due = start.Add(time.Duration(float64(i) / *qps * float64(time.Second)))
+			time.Sleep(time.Until(due))
+		}
+		if !due.Before(deadline) {
+			break
+		}
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func(q loadQuery, due time.Time) {
+			defer wg.Done()
+			failure := search(q)
+			results <- loadResult{latency: time.Since(due), failure: failure}
+			<-inFlight
+		}(next(), due)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(results)
+	<-collected
+
+	printLoadtestReport(latencies, failures, elapsed, *qps)
+}
+
+func printLoadtestReport(latencies []time.Duration, failures map[string]int, elapsed time.Duration, qps float64) {
+	n := len(latencies)
+	errors := 0
+	for _, count := range failures {
+		errors += count
+	}
+	fmt.Printf("queries:     %d\n", n)
+	if n == 0 {
+		return
+	}
+	fmt.Printf("errors:      %d (%.2f%%)\n", errors, 100*float64(errors)/float64(n))
+	kinds := make([]string, 0, len(failures))
+	for kind := range failures {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("  %-18s %d\n", kind+":", failures[kind])
+	}
+	fmt.Printf("elapsed:     %s\n", elapsed.Round(time.Millisecond))
+	if qps > 0 {
+		fmt.Printf("throughput:  %.1f queries/sec (target %.1f)\n", float64(n)/elapsed.Seconds(), qps)
+	} else {
+		fmt.Printf("throughput:  %.1f queries/sec\n", float64(n)/elapsed.Seconds())
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var sum time.Duration
+	for _, l := range latencies {
+		sum += l
+	}
+	percentile := func(p float64) time.Duration {
+		return latencies[int(math.Ceil(p*float64(n)))-1]
+	}
+	fmt.Printf("latency:     mean %s, p50 %s, p90 %s, p95 %s, p99 %s, max %s\n",
+		(sum / time.Duration(n)).Round(time.Microsecond),
+		percentile(0.5).Round(time.Microsecond), percentile(0.9).Round(time.Microsecond),
+		percentile(0.95).Round(time.Microsecond), percentile(0.99).Round(time.Microsecond),
+		latencies[n-1].Round(time.Microsecond))
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+)
+
+var ltrModelPath = flag.String("ltrModel", "",
+	"optional path to a learned ranking model written by the train command, the top hits are reranked with it when set")
+var ltrTopN = flag.Int("ltrTopN", 50, "number of top hits reranked by the learned ranking model")
+
+// ltrFeatureNames are the features of a hit the learned model weighs, in the
+// order of its weights
+var ltrFeatureNames = []string{"score", "coverage", "phrase", "length", "position"}
+
+// ltrModel is a linear model over the features of a hit, trained on pairs of
+// hits where users clicked one and skipped the other
+type ltrModel struct {
+	Features []string  `json:"features"`
+	Weights  []float64 `json:"weights"`
+	Pairs    int       `json:"pairs"`
+}
+
+var ltr = struct {
+	sync.RWMutex
+	model   *ltrModel
+	enabled bool
+}{}
+
+func loadLTRModel() error {
+	if *ltrModelPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(*ltrModelPath)
+	if err != nil {
+		return err
+	}
+	var model ltrModel
+	if err := json.Unmarshal(data, &model); err != nil {
+		return fmt.Errorf("parsing %s: %v", *ltrModelPath, err)
+	}
+	if strings.Join(model.Features, ",") != strings.Join(ltrFeatureNames, ",") || len(model.Weights) != len(ltrFeatureNames) {
+		return fmt.Errorf("%s: model features %v don't match %v, retrain it", *ltrModelPath, model.Features, ltrFeatureNames)
+	}
+
+	ltr.Lock()
+	ltr.model = &model
+	ltr.enabled = true
+	ltr.Unlock()
+	return nil
+}
+
+// activeLTRModel returns the model hits are reranked with, nil when there is
+// none or it was switched off.
+func activeLTRModel() *ltrModel {
+	ltr.RLock()
+	defer ltr.RUnlock()
+	if !ltr.enabled {
+		return nil
+	}
+	return ltr.model
+}
+
+func (m *ltrModel) score(features []float64) float64 {
+	s := 0.0
+	for i, f := range features {
+		s += m.Weights[i] * f
+	}
+	return s
+}
+
+// textTerms splits text into lower case words
+func textTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// ltrFeatures computes the features of a hit that was loaded with its Line
+// field: its score relative to the best hit, the share of the query terms
+// its text has, whether it has them as a phrase, how short it is and how
+// early in its document it comes.
+func ltrFeatures(hit *search.DocumentMatch, terms []string, maxScore float64) []float64 {
+	features := make([]float64, len(ltrFeatureNames))
+	if maxScore > 0 {
+		features[0] = hit.Score / maxScore
+	}
+
+	line, _ := hit.Fields["Line"].(string)
+	words := textTerms(line)
+	if len(terms) > 0 {
+		has := map[string]bool{}
+		for _, word := range words {
+			has[word] = true
+		}
+		covered := 0
+		for _, term := range terms {
+			if has[term] {
+				covered++
+			}
+		}
+		features[1] = float64(covered) / float64(len(terms))
+		if strings.Contains(" "+strings.Join(words, " ")+" ", " "+strings.Join(terms, " ")+" ") {
+			features[2] = 1
+		}
+	}
+	features[3] = 1 / (1 + math.Log(1+float64(len(words))))
+	if position, ok := hitPosition(hit, ""); ok {
+		features[4] = 1 / math.Log2(2+position)
+	}
+	return features
+}
+
+// rerank reorders the top n hits of a search by the model's score. The
+// scores themselves are left alone, as they aren't comparable.
+func rerank(model *ltrModel, searchTerm string, res *bleve.SearchResult, n int) {
+	if n > len(res.Hits) {
+		n = len(res.Hits)
+	}
+	terms := textTerms(searchTerm)
+	scores := make(map[*search.DocumentMatch]float64, n)
+	for _, hit := range res.Hits[:n] {
+		scores[hit] = model.score(ltrFeatures(hit, terms, res.MaxScore))
+	}
+	top := res.Hits[:n]
+	sort.SliceStable(top, func(i, j int) bool { return scores[top[i]] > scores[top[j]] })
+}
+
+// ltrHandler serves the kill switch of the learned ranking:
+//
+//	GET /admin/ltr the model and whether reranking is on
+//	PUT /admin/ltr turn reranking on or off, body {"Enabled": false}
+func ltrHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Enabled bool
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		ltr.Lock()
+		if req.Enabled && ltr.model == nil {
+			ltr.Unlock()
+			http.Error(w, "no learned ranking model is loaded", http.StatusConflict)
+			return
+		}
+		ltr.enabled = req.Enabled
+		ltr.Unlock()
+		log.Printf("learned ranking enabled: %v", req.Enabled)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ltr.RLock()
+	res := struct {
+		Enabled bool
+		Model   string
+		TopN    int
+		Weights map[string]float64
+	}{Enabled: ltr.enabled, Model: *ltrModelPath, TopN: *ltrTopN}
+	if ltr.model != nil {
+		res.Weights = map[string]float64{}
+		for i, name := range ltr.model.Features {
+			res.Weights[name] = ltr.model.Weights[i]
+		}
+	}
+	ltr.RUnlock()
+	writeJSON(w, http.StatusOK, res)
+}
+
+// trainingPairs turns the click log into pairs of feature vectors, the first
+// of a hit that was clicked and the second of one that was skipped: shown
+// above the clicked hit, or right below it, and not clicked itself. Features
+// are computed from a fresh search of each query, so hits that fell out of
+// its top n are left out.
+func trainingPairs(clicks []clickLogEntry, n int) [][2][]float64 {
+	type key struct{ index, q string }
+	byQuery := map[key][]clickLogEntry{}
+	var keys []key
+	for _, c := range clicks {
+		k := key{c.Index, c.Query}
+		if _, ok := byQuery[k]; !ok {
+			keys = append(keys, k)
+		}
+		byQuery[k] = append(byQuery[k], c)
+	}
+
+	var pairs [][2][]float64
+	for _, k := range keys {
+		res, err := performSearch(context.Background(), k.index, k.q, searchOptions{Size: n, Fields: []string{"Line"}, SkipRerank: true})
+		if err != nil {
+			log.Printf("skipping clicks on %q in %s: %v", k.q, k.index, err)
+			continue
+		}
+		terms := textTerms(k.q)
+		features := map[string][]float64{}
+		for _, hit := range res.Hits {
+			features[hit.ID] = ltrFeatures(hit, terms, res.MaxScore)
+		}
+
+		clicked := map[string]bool{}
+		for _, c := range byQuery[k] {
+			clicked[c.ID] = true
+		}
+		for _, c := range byQuery[k] {
+			rank := -1
+			for i, id := range c.Shown {
+				if id == c.ID {
+					rank = i
+					break
+				}
+			}
+			if rank < 0 || features[c.ID] == nil {
+				continue
+			}
+			skipped := append([]string{}, c.Shown[:rank]...)
+			if rank+1 < len(c.Shown) {
+				skipped = append(skipped, c.Shown[rank+1])
+			}
+			for _, id := range skipped {
+				if clicked[id] || features[id] == nil {
+					continue
+				}
+				pairs = append(pairs, [2][]float64{features[c.ID], features[id]})
+			}
+		}
+	}
+	return pairs
+}
+
+// trainLTRModel fits a pairwise logistic regression with stochastic gradient
+// descent, starting from the plain bleve score.
+func trainLTRModel(pairs [][2][]float64, epochs int, learningRate float64, l2 float64) *ltrModel {
+	model := &ltrModel{Features: ltrFeatureNames, Weights: make([]float64, len(ltrFeatureNames)), Pairs: len(pairs)}
+	model.Weights[0] = 1
+
+	diffs := make([][]float64, len(pairs))
+	for i, p := range pairs {
+		diffs[i] = make([]float64, len(ltrFeatureNames))
+		for f := range diffs[i] {
+			diffs[i][f] = p[0][f] - p[1][f]
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for epoch := 0; epoch < epochs; epoch++ {
+		rnd.Shuffle(len(diffs), func(i, j int) { diffs[i], diffs[j] = diffs[j], diffs[i] })
+		for _, x := range diffs {
+			p := 1 / (1 + math.Exp(-model.score(x)))
+			for f := range model.Weights {
+				model.Weights[f] -= learningRate * ((p-1)*x[f] + l2*model.Weights[f])
+			}
+		}
+	}
+	return model
+}
+
+// pairAccuracy is the share of pairs the model orders like the users did
+func pairAccuracy(model *ltrModel, pairs [][2][]float64) float64 {
+	if len(pairs) == 0 {
+		return 0
+	}
+	right := 0
+	for _, p := range pairs {
+		if model.score(p[0]) > model.score(p[1]) {
+			right++
+		}
+	}
+	return float64(right) / float64(len(pairs))
+}
+
+func trainCommand(args []string) {
+	flags := flag.NewFlagSet("train", flag.ExitOnError)
+	flags.StringVar(dataDir, "dataDir", *dataDir, "data directory")
+	flags.StringVar(rankingConfigPath, "rankingConfig", *rankingConfigPath, "optional path to the ranking profiles")
+	flags.StringVar(clickLogPath, "clickLog", *clickLogPath, "click log to learn from")
+	flags.IntVar(priorTopN, "priorTopN", *priorTopN, "number of top hits rescored by the positional prior, should match -priorTopN of the server")
+	out := flags.String("out", "", "path to write the model to")
+	topN := flags.Int("topN", *ltrTopN, "number of top hits of each query features are computed for, should match -ltrTopN of the server")
+	epochs := flags.Int("epochs", 50, "passes over the training pairs")
+	learningRate := flags.Float64("learningRate", 0.05, "step size of gradient descent")
+	l2 := flags.Float64("l2", 0.001, "L2 regularization strength")
+	flags.Parse(args)
+
+	if *clickLogPath == "" || *out == "" {
+		fmt.Fprintln(os.Stderr, "usage: server train -clickLog <file> -out <model file> [flags]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	indexes = newIndexManager(*dataDir, *maxOpenIndexes, *openIndexBudget)
+	// only searched, which works next to a server reading the same indexes
+	indexes.readOnly = true
+	if err := loadRankingConfig(); err != nil {
+		log.Fatalf("error loading ranking config: %v", err)
+	}
+	if err := loadAliases(); err != nil {
+		log.Fatalf("error loading aliases: %v", err)
+	}
+
+	var clicks []clickLogEntry
+	err := readClickLog(*clickLogPath, func(entry clickLogEntry) {
+		clicks = append(clicks, entry)
+	})
+	if err != nil {
+		log.Fatalf("error reading click log: %v", err)
+	}
+	pairs := trainingPairs(clicks, *topN)
+	if len(pairs) == 0 {
+		log.Fatalf("no training pairs in %d clicks", len(clicks))
+	}
+
+	baseline := &ltrModel{Features: ltrFeatureNames, Weights: make([]float64, len(ltrFeatureNames))}
+	baseline.Weights[0] = 1
+	model := trainLTRModel(pairs, *epochs, *learningRate, *l2)
+
+	data, err := json.MarshalIndent(model, "", "  ")
+	if err != nil {
+		log.Fatalf("error encoding model: %v", err)
+	}
+	if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		log.Fatalf("error writing model: %v", err)
+	}
+
+	fmt.Printf("clicks: %d, training pairs: %d\n", len(clicks), len(pairs))
+	fmt.Printf("pairs ordered right, bleve score: %.4f, model: %.4f\n",
+		pairAccuracy(baseline, pairs), pairAccuracy(model, pairs))
+	for i, name := range model.Features {
+		fmt.Printf("%-10s %+.4f\n", name, model.Weights[i])
+	}
+}
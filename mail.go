@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/mapping"
+)
+
+// mailIndexMapping indexes mail: the decoded body as Line, the address and
+// subject headers as text, thread and message_id as exact keywords and date
+// as a datetime.
+func mailIndexMapping() *mapping.IndexMappingImpl {
+	indexMapping := bleve.NewIndexMapping()
+
+	keywordField := bleve.NewTextFieldMapping()
+	keywordField.Analyzer = keyword.Name
+
+	indexMapping.DefaultMapping.AddFieldMappingsAt("thread", keywordField)
+	indexMapping.DefaultMapping.AddFieldMappingsAt("message_id", keywordField)
+	indexMapping.DefaultMapping.AddFieldMappingsAt("date", bleve.NewDateTimeFieldMapping())
+	return indexMapping
+}
+
+// mailSources returns a source per mbox file and per Maildir message under
+// dir. Maildir messages are the files in the cur and new directories of a
+// directory that also has a tmp directory. Mbox files are recognized by the
+// "From " line they start with.
+func mailSources(dir string) ([]ingestSource, error) {
+	var sources []ingestSource
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if isMaildirMessage(path) {
+			sources = append(sources, ingestSource{
+				name: path,
+				size: info.Size(),
+				read: func(emit func(string, map[string]interface{}) error) error {
+					data, err := ioutil.ReadFile(path)
+					if err != nil {
+						return err
+					}
+					id, doc, err := parseMail(data, path)
+					if err != nil {
+						return err
+					}
+					return emit(id, doc)
+				},
+			})
+			return nil
+		}
+		if isMbox(path) {
+			sources = append(sources, ingestSource{
+				name: path,
+				size: info.Size(),
+				read: func(emit func(string, map[string]interface{}) error) error {
+					return readMbox(path, emit)
+				},
+			})
+		}
+		return nil
+	})
+	sort.Slice(sources, func(i, j int) bool { return sources[i].name < sources[j].name })
+	return sources, err
+}
+
+func isMaildirMessage(path string) bool {
+	sub := filepath.Base(filepath.Dir(path))
+	if sub != "cur" && sub != "new" {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(filepath.Dir(filepath.Dir(path)), "tmp"))
+	return err == nil && info.IsDir()
+}
+
+func isMbox(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 5)
+	_, err = io.ReadFull(f, head)
+	return err == nil && string(head) == "From "
+}
+
+// skippedMessagesError reports the messages of an mbox that couldn't be
+// parsed, after the others were read
+type skippedMessagesError struct {
+	path    string
+	skipped int
+	total   int
+}
+
+func (e *skippedMessagesError) Error() string {
+	return fmt.Sprintf("%s: skipped %d of %d messages that could not be parsed", e.path, e.skipped, e.total)
+}
+
+// readMbox emits every message of an mbox file. Messages start at lines
+// beginning with "From ", and body lines that began with it are escaped as
+// ">From ", or ">>From " and so on in the mboxrd flavour. Messages that
+// can't be parsed are logged and skipped, and reported with a
+// *skippedMessagesError once the rest of the file is read.
+func readMbox(path string, emit func(string, map[string]interface{}) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var msg bytes.Buffer
+	n, skipped := 0, 0
+	flush := func() error {
+		if msg.Len() == 0 {
+			return nil
+		}
+		n++
+		id, doc, err := parseMail(msg.Bytes(), fmt.Sprintf("%s#%d", path, n))
+		msg.Reset()
+		if err != nil {
+			skipped++
+			log.Printf("skipping message: %v", err)
+			return nil
+		}
+		return emit(id, doc)
+	}
+	done := func() error {
+		if err := flush(); err != nil {
+			return err
+		}
+		if skipped > 0 {
+			return &skippedMessagesError{path: path, skipped: skipped, total: n}
+		}
+		return nil
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if ferr := flush(); ferr != nil {
+					return ferr
+				}
+			case bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")):
+				msg.Write(line[1:])
+			default:
+				msg.Write(line)
+			}
+		}
+		if err == io.EOF {
+			return done()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseMail parses one message into a document. The message ID is the
+// document ID, source names messages without one.
+func parseMail(data []byte, source string) (string, map[string]interface{}, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", source, err)
+	}
+
+	dec := new(mime.WordDecoder)
+	header := func(name string) string {
+		v := msg.Header.Get(name)
+		if decoded, err := dec.DecodeHeader(v); err == nil {
+			return decoded
+		}
+		return v
+	}
+
+	doc := map[string]interface{}{}
+	for field, name := range map[string]string{"from": "From", "to": "To", "subject": "Subject"} {
+		if v := header(name); v != "" {
+			doc[field] = v
+		}
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		doc["date"] = date
+	}
+
+	body, err := decodeMailBody(msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", source, err)
+	}
+	doc["Line"] = body
+
+	id := strings.Trim(msg.Header.Get("Message-Id"), " <>")
+	if id != "" {
+		doc["message_id"] = id
+	} else {
+		id = source
+	}
+	doc["thread"] = threadID(msg.Header, header("Subject"))
+	return id, doc, nil
+}
+
+// threadID is the message ID of the first message of the thread a message
+// belongs to, taken from References or In-Reply-To. Messages without either
+// start their own thread, unless their subject says they are a reply, in
+// which case they are grouped by subject.
+func threadID(h mail.Header, subject string) string {
+	if refs := messageIDs(h.Get("References")); len(refs) > 0 {
+		return refs[0]
+	}
+	if refs := messageIDs(h.Get("In-Reply-To")); len(refs) > 0 {
+		return refs[0]
+	}
+	normalized := normalizeSubject(subject)
+	if id := strings.Trim(h.Get("Message-Id"), " <>"); id != "" && normalized == strings.ToLower(strings.TrimSpace(subject)) {
+		return id
+	}
+	sum := sha1.Sum([]byte(normalized))
+	return "subject:" + hex.EncodeToString(sum[:8])
+}
+
+var messageIDRegexp = regexp.MustCompile(`<([^<>]+)>`)
+
+func messageIDs(s string) []string {
+	var ids []string
+	for _, m := range messageIDRegexp.FindAllStringSubmatch(s, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+var replyPrefixRegexp = regexp.MustCompile(`(?i)^\s*((re|fwd?|aw|sv)(\[\d+\])?:\s*)+`)
+
+func normalizeSubject(subject string) string {
+	return strings.ToLower(strings.TrimSpace(replyPrefixRegexp.ReplaceAllString(subject, "")))
+}
+
+// decodeMailBody returns the text of a message body, undoing its transfer
+// encoding and charset. Of multipart bodies the text/plain parts are used,
+// or the text/html parts stripped of tags when there are none.
+func decodeMailBody(contentType, transferEncoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	switch strings.ToLower(transferEncoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineSkipper{r: body})
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var plain, html []string
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			partType := part.Header.Get("Content-Type")
+			if partType == "" {
+				partType = "text/plain"
+			}
+			// multipart.Part already undoes quoted-printable
+			text, err := decodeMailBody(partType, part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", err
+			}
+			switch pt, _, _ := mime.ParseMediaType(partType); {
+			case pt == "text/plain" || strings.HasPrefix(pt, "multipart/"):
+				plain = append(plain, text)
+			case pt == "text/html":
+				html = append(html, text)
+			}
+		}
+		if len(plain) > 0 {
+			return strings.Join(plain, "\n"), nil
+		}
+		return strings.Join(html, "\n"), nil
+	}
+
+	if !strings.HasPrefix(mediaType, "text/") {
+		return "", nil
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	text := decodeCharset(data, params["charset"])
+	if mediaType == "text/html" {
+		text = stripTags(text)
+	}
+	return text, nil
+}
+
+// decodeCharset converts text in the Latin-1 family to UTF-8. Anything else
+// is assumed to be UTF-8 or ASCII already.
+func decodeCharset(data []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso-8859-15", "latin1", "windows-1252":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return string(data)
+}
+
+var tagRegexp = regexp.MustCompile(`(?s)<(script|style)\b.*?</(script|style)>|<[^>]*>`)
+
+func stripTags(html string) string {
+	return strings.TrimSpace(tagRegexp.ReplaceAllString(html, " "))
+}
+
+// newlineSkipper drops the line breaks base64 bodies are wrapped with
+type newlineSkipper struct {
+	r io.Reader
+}
+
+func (n *newlineSkipper) Read(p []byte) (int, error) {
+	for {
+		read, err := n.r.Read(p)
+		kept := 0
+		for _, b := range p[:read] {
+			if b != '\r' && b != '\n' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var queryLogPath = flag.String("queryLog", "",
+	"optional path of a file to append every search query to, one JSON object per line")
+
+type queryLogEntry struct {
+	Time  time.Time `json:"time"`
+	Index string    `json:"index"`
+	Query string    `json:"q"`
+	Hits  uint64    `json:"hits"`
+
+	// the A/B experiment variant the search ran with
+	Experiment string `json:"experiment,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+}
+
+var queryLog struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+func openQueryLog() error {
+	if *queryLogPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*queryLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	queryLog.enc = json.NewEncoder(f)
+	return nil
+}
+
+func logQuery(entry queryLogEntry) {
+	queryLog.Lock()
+	defer queryLog.Unlock()
+	if queryLog.enc == nil {
+		return
+	}
+	if err := queryLog.enc.Encode(entry); err != nil {
+		log.Printf("query log write error: %v", err)
+	}
+}
+
+// readQueryLog calls fn for every well formed entry in the query log at path.
+func readQueryLog(path string, fn func(queryLogEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry queryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		fn(entry)
+	}
+	return scanner.Err()
+}
+
+// topQueries returns the n most frequent queries logged against indexName.
+func topQueries(path string, indexName string, n int) ([]string, error) {
+	counts := map[string]int{}
+	err := readQueryLog(path, func(entry queryLogEntry) {
+		if entry.Index == indexName && entry.Query != "" {
+			counts[entry.Query]++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	queries := make([]string, 0, len(counts))
+	for q := range counts {
+		queries = append(queries, q)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if counts[queries[i]] != counts[queries[j]] {
+			return counts[queries[i]] > counts[queries[j]]
+		}
+		return queries[i] < queries[j]
+	})
+	if len(queries) > n {
+		queries = queries[:n]
+	}
+	return queries, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+var rankingConfigPath = flag.String("rankingConfig", "",
+	"optional path to a JSON file of named ranking profiles and the default profile of each index")
+var priorTopN = flag.Int("priorTopN", 1000,
+	"number of top hits rescored by the positional prior of searches asking for fewer, like those of eval and train")
+
+// rankingProfile is a named way of scoring hits
+type rankingProfile struct {
+	// Fields are the fields searched in match and phrase mode with their
+	// boosts, all fields (_all) unboosted when empty
+	Fields map[string]float64 `json:"fields"`
+
+	// PhraseBoost, when set, adds a phrase match of the whole query to
+	// match mode searches, boosted by this factor on top of the field boost
+	PhraseBoost float64 `json:"phraseBoost"`
+
+	// PositionalPrior favors hits that come early in their document
+	PositionalPrior *positionalPrior `json:"positionalPrior"`
+}
+
+// positionalPrior multiplies scores by 1 + Weight/log2(2 + position), where
+// position is the numeric Field of a hit, or the number its ID ends with when
+// Field is empty, like the line number in "Book 1 - The Philosopher's Stone: 12"
+type positionalPrior struct {
+	Field  string  `json:"field"`
+	Weight float64 `json:"weight"`
+}
+
+type rankingConfig struct {
+	Profiles map[string]*rankingProfile `json:"profiles"`
+
+	// Defaults maps index names, or aliases, to the profile used when a
+	// search doesn't ask for one
+	Defaults map[string]string `json:"defaults"`
+}
+
+var ranking = struct {
+	sync.RWMutex
+	config rankingConfig
+}{}
+
+func loadRankingConfig() error {
+	if *rankingConfigPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(*rankingConfigPath)
+	if err != nil {
+		return err
+	}
+	var config rankingConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parsing %s: %v", *rankingConfigPath, err)
+	}
+	for indexName, name := range config.Defaults {
+		if _, ok := config.Profiles[name]; !ok {
+			return fmt.Errorf("default profile %q of %s is not defined", name, indexName)
+		}
+	}
+
+	ranking.Lock()
+	ranking.config = config
+	ranking.Unlock()
+	return nil
+}
+
+// rankingProfileFor returns the named profile, or the default profile of the
+// index when name is empty. It returns nil when neither is set, meaning
+// bleve's default scoring.
+func rankingProfileFor(indexName string, name string) (*rankingProfile, error) {
+	ranking.RLock()
+	defer ranking.RUnlock()
+
+	if name == "" {
+		name = ranking.config.Defaults[indexName]
+		if name == "" {
+			return nil, nil
+		}
+	}
+	profile, ok := ranking.config.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown ranking profile %q", name)
+	}
+	return profile, nil
+}
+
+// search modes, how the q parameter is read
+const (
+	modeMatch  = "match"  // any of the terms, the default
+	modePhrase = "phrase" // the terms next to each other in order
+	modeQuery  = "query"  // bleve query string syntax with fields, wildcards, +must and -must not
+)
+
+func validMode(mode string) bool {
+	return mode == "" || mode == modeMatch || mode == modePhrase || mode == modeQuery
+}
+
+// textQuery builds the query for searchTerm in the given mode, analyzing it
+// with analyzer unless that is empty, and weighting fields by the profile.
+func textQuery(searchTerm string, mode string, analyzer string, profile *rankingProfile) query.Query {
+	if mode == modeQuery {
+		return bleve.NewQueryStringQuery(searchTerm)
+	}
+
+	fields := map[string]float64{"": 1}
+	phraseBoost := 0.0
+	if profile != nil {
+		if len(profile.Fields) > 0 {
+			fields = profile.Fields
+		}
+		phraseBoost = profile.PhraseBoost
+	}
+
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	var disjuncts []query.Query
+	for _, field := range names {
+		boost := fields[field]
+		if mode == modePhrase {
+			disjuncts = append(disjuncts, phraseQuery(searchTerm, field, analyzer, boost))
+			continue
+		}
+
+		matchQuery := bleve.NewMatchQuery(searchTerm)
+		matchQuery.SetField(field)
+		matchQuery.Analyzer = analyzer
+		if boost != 1 {
+			matchQuery.SetBoost(boost)
+		}
+		disjuncts = append(disjuncts, matchQuery)
+		if phraseBoost > 0 {
+			disjuncts = append(disjuncts, phraseQuery(searchTerm, field, analyzer, boost*phraseBoost))
+		}
+	}
+	if len(disjuncts) == 1 {
+		return disjuncts[0]
+	}
+	return bleve.NewDisjunctionQuery(disjuncts...)
+}
+
+func phraseQuery(searchTerm string, field string, analyzer string, boost float64) query.Query {
+	phrase := bleve.NewMatchPhraseQuery(searchTerm)
+	phrase.SetField(field)
+	phrase.Analyzer = analyzer
+	if boost != 1 {
+		phrase.SetBoost(boost)
+	}
+	return phrase
+}
+
+var trailingNumber = regexp.MustCompile(`(\d+)$`)
+
+// applyPositionalPrior rescales hit scores by their position and re-sorts the
+// hits. Hits without a position keep their score.
+func applyPositionalPrior(res *bleve.SearchResult, prior *positionalPrior) {
+	res.MaxScore = 0
+	for _, hit := range res.Hits {
+		if position, ok := hitPosition(hit, prior.Field); ok && position >= 0 {
+			hit.Score *= 1 + prior.Weight/math.Log2(2+position)
+		}
+		if hit.Score > res.MaxScore {
+			res.MaxScore = hit.Score
+		}
+	}
+	sort.SliceStable(res.Hits, func(i, j int) bool { return res.Hits[i].Score > res.Hits[j].Score })
+}
+
+func hitPosition(hit *search.DocumentMatch, field string) (float64, bool) {
+	if field == "" {
+		m := trailingNumber.FindString(hit.ID)
+		if m == "" {
+			return 0, false
+		}
+		n, err := strconv.ParseFloat(m, 64)
+		return n, err == nil
+	}
+	n, ok := hit.Fields[field].(float64)
+	return n, ok
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search"
+)
+
+// reindexCheckpoint records how far a reindex got. Every document with an ID
+// up to and including LastID has been written to the destination index.
+type reindexCheckpoint struct {
+	LastID  string
+	Indexed uint64
+}
+
+type reindexBatch struct {
+	seq  int
+	hits []*search.DocumentMatch
+	err  error
+}
+
+// reindexCommand rebuilds an index from the stored fields of another one,
+// optionally with a new mapping:
+//
+//	server reindex -src data/hpotter.bleve -dst data/hpotter-v2.bleve -mapping mapping.json
+//
+// Only stored fields survive the trip, which is every field of indexes built
+// with the default dynamic mapping. It refuses to run on indexes a server has
+// open, so nothing writes to the source while it is copied; stop the server,
+// or reindex a copy taken with a snapshot.
+func reindexCommand(args []string) {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	srcPath := flags.String("src", "", "path of the index to read documents from")
+	dstPath := flags.String("dst", "", "path of the index to write documents to")
+	mappingPath := flags.String("mapping", "",
+		"optional path to a JSON index mapping for the new index, defaults to the mapping of -src")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of batches indexed in parallel")
+	batchSize := flags.Int("batchSize", 1000, "number of documents per batch")
+	checkpointPath := flags.String("checkpoint", "",
+		"path of the checkpoint file used to resume an interrupted reindex, defaults to <dst>.checkpoint")
+	flags.Parse(args)
+
+	if *srcPath == "" || *dstPath == "" || *workers <= 0 || *batchSize <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *checkpointPath == "" {
+		*checkpointPath = *dstPath + ".checkpoint"
+	}
+
+	src, err := openExisting(*srcPath, true)
+	if err != nil {
+		log.Fatalf("error opening index %s: %v", *srcPath, err)
+	}
+	defer src.Close()
+
+	checkpoint, err := readCheckpoint(*checkpointPath)
+	if err != nil {
+		log.Fatalf("error reading checkpoint: %v", err)
+	}
+
+	// a reindex that died before its first checkpoint leaves the destination
+	// behind, which is written again from the start; indexing by ID makes
+	// that safe
+	var dst bleve.Index
+	if _, statErr := os.Stat(*dstPath); statErr == nil {
+		if checkpoint.LastID != "" {
+			log.Printf("resuming reindex after %q, %d documents already indexed", checkpoint.LastID, checkpoint.Indexed)
+		} else {
+			log.Printf("%s exists without a checkpoint, reindexing every document into it", *dstPath)
+		}
+		dst, err = openExisting(*dstPath, false)
+	} else {
+		if checkpoint.LastID != "" {
+			log.Printf("%s is gone, ignoring the checkpoint", *dstPath)
+			checkpoint = reindexCheckpoint{}
+		}
+		var indexMapping mapping.IndexMapping
+		indexMapping, err = loadMapping(*mappingPath, src)
+		if err != nil {
+			log.Fatalf("error loading mapping: %v", err)
+		}
+		dst, err = bleve.New(*dstPath, indexMapping)
+	}
+	if err != nil {
+		log.Fatalf("error opening index %s: %v", *dstPath, err)
+	}
+	defer dst.Close()
+
+	total, err := src.DocCount()
+	if err != nil {
+		log.Fatalf("error counting documents: %v", err)
+	}
+
+	start := time.Now()
+	batches := make(chan reindexBatch, *workers)
+	done := make(chan reindexBatch, *workers)
+
+	// read pages of stored documents in _id order so that the last ID of a
+	// page is enough to resume from
+	var readErr error
+	go func() {
+		defer close(batches)
+		after := checkpoint.LastID
+		for seq := 0; ; seq++ {
+			req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), *batchSize, 0, false)
+			req.Fields = []string{"*"}
+			req.SortBy([]string{"_id"})
+			if after != "" {
+				req.SearchAfter = []string{after}
+			}
+			res, err := src.Search(req)
+			if err != nil {
+				readErr = err
+				return
+			}
+			if len(res.Hits) == 0 {
+				return
+			}
+			batches <- reindexBatch{seq: seq, hits: res.Hits}
+			after = res.Hits[len(res.Hits)-1].ID
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				batch := dst.NewBatch()
+				for _, hit := range b.hits {
+					if err := batch.Index(hit.ID, hit.Fields); err != nil {
+						b.err = fmt.Errorf("document %q: %v", hit.ID, err)
+					}
+				}
+				if b.err == nil {
+					b.err = dst.Batch(batch)
+				}
+				done <- b
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// batches finish out of order, so only checkpoint the end of the longest
+	// run of batches written without error
+	var writeErr error
+	finished := map[int]reindexBatch{}
+	next := 0
+	lastReport := time.Now()
+	for b := range done {
+		if b.err != nil {
+			if writeErr == nil {
+				writeErr = b.err
+			}
+			continue
+		}
+		finished[b.seq] = b
+		for {
+			fb, ok := finished[next]
+			if !ok {
+				break
+			}
+			delete(finished, next)
+			next++
+			checkpoint.LastID = fb.hits[len(fb.hits)-1].ID
+			checkpoint.Indexed += uint64(len(fb.hits))
+		}
+		if err := writeCheckpoint(*checkpointPath, checkpoint); err != nil {
+			log.Printf("error writing checkpoint: %v", err)
+		}
+		if time.Since(lastReport) > 5*time.Second {
+			log.Printf("reindexed %d/%d documents", checkpoint.Indexed, total)
+			lastReport = time.Now()
+		}
+	}
+	if readErr != nil {
+		log.Fatalf("error reading from %s: %v", *srcPath, readErr)
+	}
+	if writeErr != nil {
+		log.Fatalf("error writing to %s: %v", *dstPath, writeErr)
+	}
+
+	dstCount, err := dst.DocCount()
+	if err != nil {
+		log.Fatalf("error counting documents: %v", err)
+	}
+	if dstCount != total {
+		log.Fatalf("document count mismatch: %s has %d documents, %s has %d", *srcPath, total, *dstPath, dstCount)
+	}
+	os.Remove(*checkpointPath)
+	log.Printf("reindexed %d documents from %s into %s in %s", dstCount, *srcPath, *dstPath, time.Since(start))
+}
+
+func loadMapping(path string, src bleve.Index) (mapping.IndexMapping, error) {
+	if path == "" {
+		return src.Mapping(), nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	indexMapping := bleve.NewIndexMapping()
+	if err := json.Unmarshal(data, indexMapping); err != nil {
+		return nil, err
+	}
+	return indexMapping, indexMapping.Validate()
+}
+
+func readCheckpoint(path string) (reindexCheckpoint, error) {
+	var checkpoint reindexCheckpoint
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return checkpoint, err
+	}
+	return checkpoint, json.Unmarshal(data, &checkpoint)
+}
+
+func writeCheckpoint(path string, checkpoint reindexCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/index/scorch"
+)
+
+var snapshotDir = flag.String("snapshotDir", filepath.Join(os.TempDir(), "document-search-snapshots"),
+	"directory a primary keeps the index snapshots replicas download in, outside the data directory")
+var snapshotGrace = flag.Duration("snapshotGrace", time.Minute,
+	"how long a snapshot replaced by a newer one can still be downloaded, replicas start downloading right after polling")
+var replicaOf = flag.String("replicaOf", "",
+	"base URL of a primary to replicate indexes from, like http://primary:8095; replicas are read only")
+var snapshotToken = flag.String("snapshotToken", "",
+	"bearer token that only downloads index snapshots, for replicas, which then don't need the admin token")
+var replicaToken = flag.String("replicaToken", "", "snapshot token, or admin token, of the primary")
+var replicaIndexes = flag.String("replicaIndexes", "",
+	"comma separated indexes to replicate, every index of the primary when empty")
+var replicaInterval = flag.Duration("replicaInterval", 30*time.Second, "interval between polls of the primary")
+
+// replicaVersionFile is where a replica records, inside the index directory,
+// which snapshot of the primary the index is
+const replicaVersionFile = "replica.json"
+
+// snapshotManifest describes a snapshot of an index on the primary
+type snapshotManifest struct {
+	Index   string
+	Version string // unique per snapshot, newer ones sort later
+	Created time.Time
+	Size    int64
+	SHA256  string
+}
+
+// shippedSnapshot is a snapshot the primary made of an index
+type shippedSnapshot struct {
+	manifest    snapshotManifest
+	path        string
+	fingerprint string    // of the content of the index, see indexFingerprint
+	writes      uint64    // writes to the index when the snapshot was taken
+	replaced    time.Time // when a newer snapshot of the index was taken
+}
+
+// shippedRecord is what the primary keeps of the latest snapshot of an index
+// next to it in the snapshot directory, so that a restart, which starts the
+// write counts over, doesn't make replicas download unchanged indexes again
+type shippedRecord struct {
+	Manifest    snapshotManifest
+	Fingerprint string
+}
+
+// shippedIndex holds the snapshots of an index that can be downloaded, the
+// latest one and the ones it replaced until their grace period is over
+type shippedIndex struct {
+	build    sync.Mutex // held while a snapshot of the index is taken
+	latest   *shippedSnapshot
+	replaced []*shippedSnapshot
+}
+
+var shipped = struct {
+	sync.Mutex
+	byIndex map[string]*shippedIndex
+}{
+	byIndex: map[string]*shippedIndex{},
+}
+
+func shippedIndexFor(name string) *shippedIndex {
+	shipped.Lock()
+	defer shipped.Unlock()
+	si, ok := shipped.byIndex[name]
+	if !ok {
+		si = &shippedIndex{}
+		shipped.byIndex[name] = si
+	}
+	return si
+}
+
+// currentSnapshot returns the snapshot of the named index, taking a new one
+// when the index changed since the last one. Snapshots of an index are taken
+// one at a time, polls of other indexes don't wait for them.
+func currentSnapshot(name string) (*shippedSnapshot, error) {
+	si := shippedIndexFor(name)
+	si.build.Lock()
+	defer si.build.Unlock()
+
+	writes := indexes.Writes(name)
+	shipped.Lock()
+	latest := si.latest
+	shipped.Unlock()
+	if latest != nil && latest.writes == writes {
+		return latest, nil
+	}
+	if latest == nil {
+		latest = loadShippedRecord(name)
+	}
+
+	index, release, err := indexes.Acquire(name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	// writes don't always change the content, and the count of the latest
+	// snapshot taken before a restart is lost
+	fingerprint, err := indexFingerprint(index)
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil && fingerprint != "" && latest.fingerprint == fingerprint {
+		latest.writes = writes
+		shipped.Lock()
+		restarted := si.latest == nil
+		si.latest = latest
+		shipped.Unlock()
+		if restarted {
+			removeStaleSnapshots(name, latest.path)
+		}
+		return latest, nil
+	}
+
+	copyable, ok := index.(bleve.IndexCopyable)
+	if !ok {
+		return nil, fmt.Errorf("index %s cannot be copied", name)
+	}
+
+	start := time.Now()
+	version := strconv.FormatInt(start.UnixNano(), 10)
+	copyDir := filepath.Join(*snapshotDir, name+"."+version)
+	defer os.RemoveAll(copyDir)
+	if err := copyable.CopyTo(bleve.FileSystemDirectory(copyDir)); err != nil {
+		return nil, err
+	}
+
+	s := &shippedSnapshot{
+		manifest:    snapshotManifest{Index: name, Version: version, Created: start},
+		path:        copyDir + ".tar",
+		fingerprint: fingerprint,
+		writes:      writes,
+	}
+	s.manifest.Size, s.manifest.SHA256, err = writeTar(s.path, copyDir)
+	if err != nil {
+		os.Remove(s.path)
+		return nil, err
+	}
+	if err := saveShippedRecord(name, s); err != nil {
+		log.Printf("error recording snapshot %s of %s: %v", version, name, err)
+	}
+	shipped.Lock()
+	restarted := si.latest == nil
+	shipped.Unlock()
+	if restarted {
+		removeStaleSnapshots(name, s.path)
+	}
+
+	shipped.Lock()
+	defer shipped.Unlock()
+	if si.latest != nil {
+		// replicas that were told about it still get to download it
+		si.latest.replaced = start
+		si.replaced = append(si.replaced, si.latest)
+	}
+	si.latest = s
+	si.expire()
+	log.Printf("took snapshot %s of %s, %d bytes in %s", version, name, s.manifest.Size, time.Since(start))
+	return s, nil
+}
+
+// indexFingerprint identifies the content of a scorch index by the segments
+// of its current snapshot and the documents deleted from them. Writes and
+// merges change it, reopening the index doesn't. It is empty for other
+// kinds of index.
+func indexFingerprint(index bleve.Index) (string, error) {
+	advanced, err := index.Advanced()
+	if err != nil {
+		return "", err
+	}
+	reader, err := advanced.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	snapshot, ok := reader.(*scorch.IndexSnapshot)
+	if !ok {
+		return "", nil
+	}
+
+	hash := sha256.New()
+	var buf [8]byte
+	for _, segment := range snapshot.Segments() {
+		binary.BigEndian.PutUint64(buf[:], segment.Id())
+		hash.Write(buf[:])
+		deleted := segment.Deleted()
+		if deleted == nil {
+			binary.BigEndian.PutUint64(buf[:], 0)
+			hash.Write(buf[:])
+			continue
+		}
+		binary.BigEndian.PutUint64(buf[:], deleted.GetCardinality())
+		hash.Write(buf[:])
+		it := deleted.Iterator()
+		for it.HasNext() {
+			binary.BigEndian.PutUint32(buf[:4], it.Next())
+			hash.Write(buf[:4])
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func shippedRecordPath(name string) string {
+	return filepath.Join(*snapshotDir, name+".json")
+}
+
+// loadShippedRecord returns the latest snapshot of the named index taken
+// before the server restarted, nil when there is none or its tar is gone
+func loadShippedRecord(name string) *shippedSnapshot {
+	data, err := ioutil.ReadFile(shippedRecordPath(name))
+	if err != nil {
+		return nil
+	}
+	var record shippedRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		log.Printf("ignoring %s: %v", shippedRecordPath(name), err)
+		return nil
+	}
+	path := filepath.Join(*snapshotDir, name+"."+record.Manifest.Version+".tar")
+	if info, err := os.Stat(path); err != nil || info.Size() != record.Manifest.Size {
+		return nil
+	}
+	return &shippedSnapshot{manifest: record.Manifest, path: path, fingerprint: record.Fingerprint}
+}
+
+func saveShippedRecord(name string, s *shippedSnapshot) error {
+	data, err := json.Marshal(shippedRecord{Manifest: s.manifest, Fingerprint: s.fingerprint})
+	if err != nil {
+		return err
+	}
+	tmp := shippedRecordPath(name) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, shippedRecordPath(name))
+}
+
+// expire removes the replaced snapshots whose grace period is over.
+// Downloads in progress keep reading them from the open file. Callers hold
+// the shipped lock.
+func (si *shippedIndex) expire() {
+	kept := si.replaced[:0]
+	for _, s := range si.replaced {
+		if time.Since(s.replaced) > *snapshotGrace {
+			os.Remove(s.path)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	si.replaced = kept
+}
+
+// shippedSnapshotVersion returns the snapshot of the named index with the
+// given version, nil once it is gone
+func shippedSnapshotVersion(name string, version string) *shippedSnapshot {
+	shipped.Lock()
+	defer shipped.Unlock()
+	si, ok := shipped.byIndex[name]
+	if !ok {
+		return nil
+	}
+	si.expire()
+	if si.latest != nil && si.latest.manifest.Version == version {
+		return si.latest
+	}
+	for _, s := range si.replaced {
+		if s.manifest.Version == version {
+			return s
+		}
+	}
+	return nil
+}
+
+// removeStaleSnapshots removes the snapshots of the named index left over
+// from before a restart, all but the one at keep
+func removeStaleSnapshots(name string, keep string) {
+	paths, _ := filepath.Glob(filepath.Join(*snapshotDir, name+".*.tar"))
+	for _, path := range paths {
+		version := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), name+"."), ".tar")
+		if _, err := strconv.ParseInt(version, 10, 64); err == nil && path != keep {
+			os.Remove(path)
+		}
+	}
+}
+
+// writeTar archives the files under dir into a tar file at path and returns
+// its size and SHA-256
+func writeTar(path string, dir string) (int64, string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(f, hash)}
+	tw := tar.NewWriter(counter)
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		src, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	return counter.n, hex.EncodeToString(hash.Sum(nil)), err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// snapshotsHandler serves the snapshots replicas poll:
+//
+//	GET /admin/snapshots/{index}               manifest of the latest snapshot
+//	GET /admin/snapshots/{index}/{version}.tar the snapshot itself
+//
+// A snapshot is taken when the manifest is asked for and the index changed
+// since the last one. Replaced snapshots can still be downloaded for
+// -snapshotGrace, so that replicas catch up while the index is written to.
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/admin/snapshots/"), "/", 2)
+	name := parts[0]
+	if name == "" {
+		http.Error(w, "expected /admin/snapshots/{index}", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		s, err := currentSnapshot(name)
+		if err != nil {
+			log.Printf("error taking snapshot of %s: %v", name, err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.manifest)
+		return
+	}
+	s := shippedSnapshotVersion(name, strings.TrimSuffix(parts[1], ".tar"))
+	if s == nil || !strings.HasSuffix(parts[1], ".tar") {
+		http.Error(w, "no such snapshot, fetch the manifest again", http.StatusGone)
+		return
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/x-tar")
+	http.ServeContent(w, r, "", s.manifest.Created, f)
+}
+
+// replicaStatus is how far behind the primary a replicated index is
+type replicaStatus struct {
+	Index     string
+	Version   string `json:",omitempty"` // of the snapshot being served
+	Primary   string `json:",omitempty"` // latest version on the primary
+	Behind    bool
+	Lag       string // time since the index was last known to match the primary
+	LagMs     int64
+	InSync    time.Time
+	LastCheck time.Time
+	LastSwap  time.Time
+	Error     string `json:",omitempty"`
+}
+
+var replicas = struct {
+	sync.Mutex
+	status map[string]*replicaStatus
+}{
+	status: map[string]*replicaStatus{},
+}
+
+// replicationStatus reports the lag of every replicated index, nil unless
+// the server is a replica
+func replicationStatus() []replicaStatus {
+	if *replicaOf == "" {
+		return nil
+	}
+	replicas.Lock()
+	defer replicas.Unlock()
+	res := []replicaStatus{}
+	for _, s := range replicas.status {
+		status := *s
+		lag := time.Since(startTime)
+		if !s.InSync.IsZero() {
+			lag = time.Since(s.InSync)
+		}
+		status.Lag = lag.Round(time.Millisecond).String()
+		status.LagMs = lag.Milliseconds()
+		res = append(res, status)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Index < res[j].Index })
+	return res
+}
+
+func updateReplicaStatus(name string, update func(s *replicaStatus)) {
+	replicas.Lock()
+	defer replicas.Unlock()
+	s, ok := replicas.status[name]
+	if !ok {
+		s = &replicaStatus{Index: name}
+		replicas.status[name] = s
+	}
+	update(s)
+}
+
+// startReplica polls the primary in the background and swaps in every new
+// snapshot of the replicated indexes.
+func startReplica() error {
+	if *replicaOf == "" {
+		return nil
+	}
+	if _, err := url.Parse(*replicaOf); err != nil {
+		return fmt.Errorf("invalid -replicaOf: %v", err)
+	}
+	client := &http.Client{}
+	go func() {
+		for {
+			names, err := replicatedIndexes(client)
+			if err != nil {
+				log.Printf("error listing the indexes of %s: %v", *replicaOf, err)
+			}
+			for _, name := range names {
+				err := syncReplica(client, name)
+				updateReplicaStatus(name, func(s *replicaStatus) {
+					s.LastCheck = time.Now()
+					s.Error = ""
+					if err != nil {
+						s.Error = err.Error()
+					}
+				})
+				if err != nil {
+					log.Printf("error replicating %s: %v", name, err)
+				}
+			}
+			time.Sleep(*replicaInterval)
+		}
+	}()
+	log.Printf("replicating from %s every %s", *replicaOf, *replicaInterval)
+	return nil
+}
+
+func primaryGet(client *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(*replicaOf, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+*replicaToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func replicatedIndexes(client *http.Client) ([]string, error) {
+	if *replicaIndexes != "" {
+		return strings.Split(*replicaIndexes, ","), nil
+	}
+	resp, err := primaryGet(client, "/indexes")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Indexes []indexStats
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, s := range res.Indexes {
+		names = append(names, s.Name)
+	}
+	return names, nil
+}
+
+// syncReplica brings the named index up to date with the primary: when the
+// primary has a new snapshot it is downloaded, checked against its SHA-256,
+// unpacked and verified next to the index, then swapped in for it.
+func syncReplica(client *http.Client, name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid index name %q", name)
+	}
+	resp, err := primaryGet(client, "/admin/snapshots/"+url.PathEscape(name))
+	if err != nil {
+		return err
+	}
+	var manifest snapshotManifest
+	err = json.NewDecoder(resp.Body).Decode(&manifest)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	checked := time.Now()
+	local := localReplicaVersion(name)
+	updateReplicaStatus(name, func(s *replicaStatus) {
+		s.Version, s.Primary = local, manifest.Version
+		s.Behind = local != manifest.Version
+		if !s.Behind {
+			s.InSync = checked
+		}
+	})
+	if local == manifest.Version {
+		return nil
+	}
+
+	start := time.Now()
+	unpacked := filepath.Join(*dataDir, "."+name+"."+manifest.Version)
+	defer os.RemoveAll(unpacked)
+	if err := downloadSnapshot(client, manifest, unpacked); err != nil {
+		return err
+	}
+	report := verifyIndex(name, unpacked)
+	if !report.OK {
+		for _, p := range report.Problems {
+			if p.Severity == "error" {
+				return fmt.Errorf("snapshot %s fails verification: %s: %s", manifest.Version, p.Where, p.Problem)
+			}
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(unpacked, replicaVersionFile), data, 0644); err != nil {
+		return err
+	}
+
+	// swap the directories while the index is closed, searches of it fail
+	// with 503 for that long
+	indexes.register(name)
+	old := filepath.Join(*dataDir, "."+name+".old")
+	err = indexes.Exclusive(name, 30*time.Second, func(path string) error {
+		os.RemoveAll(old)
+		if err := os.Rename(path, old); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(unpacked, path); err != nil {
+			os.Rename(old, path)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(old)
+
+	log.Printf("replicated snapshot %s of %s in %s", manifest.Version, name, time.Since(start))
+	updateReplicaStatus(name, func(s *replicaStatus) {
+		s.Version = manifest.Version
+		s.Behind = false
+		s.InSync = checked
+		s.LastSwap = time.Now()
+	})
+	return nil
+}
+
+func localReplicaVersion(name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(indexes.path(name), replicaVersionFile))
+	if err != nil {
+		return ""
+	}
+	var manifest snapshotManifest
+	if json.Unmarshal(data, &manifest) != nil {
+		return ""
+	}
+	return manifest.Version
+}
+
+// downloadSnapshot unpacks the snapshot of a manifest into dir, failing when
+// the download doesn't match the size and SHA-256 of the manifest
+func downloadSnapshot(client *http.Client, manifest snapshotManifest, dir string) error {
+	resp, err := primaryGet(client, "/admin/snapshots/"+url.PathEscape(manifest.Index)+"/"+manifest.Version+".tar")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the tar is kept until its checksum is known good, rather than unpacked
+	// while it streams in
+	tmp, err := ioutil.TempFile(*dataDir, "."+manifest.Index+".download")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); n != manifest.Size || sum != manifest.SHA256 {
+		return fmt.Errorf("snapshot %s is corrupt, got %d bytes with SHA-256 %s, expected %d bytes with %s",
+			manifest.Version, n, sum, manifest.Size, manifest.SHA256)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tr := tar.NewReader(tmp)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(header.Name)
+		if header.Typeflag != tar.TypeReg || filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+			return fmt.Errorf("unexpected entry %q in snapshot", header.Name)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
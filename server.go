@@ -10,7 +10,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -18,8 +20,13 @@ import (
 	"math"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/document"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
 )
 
 var bindAddr = flag.String("addr", ":8095", "http listen address")
@@ -27,10 +34,77 @@ var dataDir = flag.String("dataDir", "data", "data directory")
 var staticBleveMappingPath = flag.String("staticBleveMapping", "",
 	"optional path to static-bleve-mapping directory for web resources")
 
+// commands are run instead of the server when named as the first argument
+var commands = map[string]func(args []string){
+	"eval":     evalCommand,
+	"import":   importCommand,
+	"ingest":   ingestCommand,
+	"loadtest": loadtestCommand,
+	"reindex":  reindexCommand,
+	"train":    trainCommand,
+	"verify":   verifyCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
+	if *replicaOf != "" {
+		// replicas only change by taking the snapshots of the primary
+		*readOnly = true
+	}
+
+	err := openQueryLog()
+	if err != nil {
+		log.Fatalf("error opening query log: %v", err)
+	}
+
+	err = openClickLog()
+	if err != nil {
+		log.Fatalf("error opening click log: %v", err)
+	}
+
+	indexes = newIndexManager(*dataDir, *maxOpenIndexes, *openIndexBudget)
+	indexes.readOnly = *readOnly
+
+	err = openSlowQueryLog()
+	if err != nil {
+		log.Fatalf("error opening slow query log: %v", err)
+	}
+
+	err = startTracing()
+	if err != nil {
+		log.Fatalf("error starting tracing: %v", err)
+	}
+	startBreaker()
+
+	err = loadRankingConfig()
+	if err != nil {
+		log.Fatalf("error loading ranking config: %v", err)
+	}
+
+	err = loadLTRModel()
+	if err != nil {
+		log.Fatalf("error loading learned ranking model: %v", err)
+	}
+
+	err = loadExperiments()
+	if err != nil {
+		log.Fatalf("error loading experiments: %v", err)
+	}
+
+	err = loadAliases()
+	if err != nil {
+		log.Fatalf("error loading aliases: %v", err)
+	}
 
 	// walk the data dir and register index names
+	var indexNames []string
 	dirEntries, err := ioutil.ReadDir(*dataDir)
 	if err != nil {
 		log.Fatalf("error reading data dir: %v", err)
@@ -39,34 +113,76 @@ func main() {
 	for _, dirInfo := range dirEntries {
 		indexPath := *dataDir + string(os.PathSeparator) + dirInfo.Name()
 
+		// dot directories are snapshots being unpacked or swapped out
+		if strings.HasPrefix(dirInfo.Name(), ".") {
+			continue
+		}
+
 		// skip single files in data dir since a valid index is a directory that
 		// contains multiple files
 		if !dirInfo.IsDir() {
+			if dirInfo.Name() == aliasFileName || dirInfo.Name() == watchFileName {
+				continue
+			}
 			log.Printf("not registering %s, skipping", indexPath)
 			continue
 		}
 
-		i, err := bleve.Open(indexPath)
+		indexes.register(dirInfo.Name())
+		_, release, err := indexes.Acquire(dirInfo.Name())
 		if err != nil {
 			log.Printf("error opening index %s: %v", indexPath, err)
 			panic("no index")
 		}
+		release()
 		log.Printf("registered index: %s", dirInfo.Name())
-		// set correct name in stats
-		i.SetName(dirInfo.Name())
-		i.Close()
+		indexNames = append(indexNames, dirInfo.Name())
+	}
+
+	// warm up in the background so /readyz can report progress
+	go warmup(indexNames)
+
+	err = startWatching()
+	if err != nil {
+		log.Fatalf("error watching inboxes: %v", err)
 	}
 
-	// start the HTTP server
-	// http.Handle("/", router)
-	http.HandleFunc("/search", searchHandler)
+	err = startReplica()
+	if err != nil {
+		log.Fatalf("error starting replication: %v", err)
+	}
+
+	// start the HTTP server, on a mux of its own so that nothing registered
+	// on http.DefaultServeMux, like the debug handlers, is ever public
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", searchHandler)
+	mux.HandleFunc("/click", clickHandler)
+	mux.HandleFunc("/validate", validateHandler)
+	mux.HandleFunc("/analyze/", analyzeHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/indexes", indexesHandler)
+	mux.HandleFunc("/documents/", documentsHandler)
+	mux.HandleFunc("/admin/aliases", adminOnly(aliasesHandler))
+	mux.HandleFunc("/admin/aliases/", adminOnly(aliasesHandler))
+	mux.HandleFunc("/admin/watch", adminOnly(watchHandler))
+	mux.HandleFunc("/admin/import/", adminOnly(importHandler))
+	mux.HandleFunc("/admin/ltr", adminToggle(ltrHandler))
+	mux.HandleFunc("/admin/experiments/report", adminOnly(experimentsReportHandler))
+	mux.HandleFunc("/admin/slowlog", adminOnly(slowQueriesHandler))
+	mux.HandleFunc("/admin/terms/", adminOnly(termsHandler))
+	mux.HandleFunc("/admin/verify/", adminOnly(verifyHandler))
+	mux.HandleFunc("/admin/compact/", adminOnly(compactHandler))
+	mux.HandleFunc("/admin/snapshots/", snapshotReader(snapshotsHandler))
+	startDebug(mux)
+
 	log.Printf("Listening on %v", *bindAddr)
-	log.Fatal(http.ListenAndServe(*bindAddr, addCorsHeaders(http.DefaultServeMux)))
+	log.Fatal(http.ListenAndServe(*bindAddr, addCorsHeaders(mux)))
 }
 
 type SearchRes struct {
-	Name string
-	Line []string
+	Name    string
+	Line    []string
+	Aligned *alignedPassage `json:",omitempty"`
 }
 
 func searchHandler(w http.ResponseWriter, r *http.Request) {
@@ -75,12 +191,65 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// example query: http://localhost:8095/search?i=hpotter.bleve&q=nimbus
+	start := time.Now()
+	ctx, requestSpan := startRequestSpan(r, "GET /search")
+	defer requestSpan.finish()
 	indexPath := r.URL.Query().Get("i")
 	searchTerm := r.URL.Query().Get("q")
-	searchResults, err := performSearch(indexPath, searchTerm)
+	requestSpan.setAttr("search.index", indexPath)
+	opts := searchOptions{
+		Lang:    r.URL.Query().Get("lang"),
+		Aligned: r.URL.Query().Get("aligned"),
+		Mode:    r.URL.Query().Get("mode"),
+		Profile: r.URL.Query().Get("profile"),
+	}
+	if err := validateSearchOptions(indexPath, opts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config := searchConfig{Index: indexPath, Opts: opts}
+	exp, variant, uid := assignVariant(w, r, indexPath)
+	if variant != nil {
+		var err error
+		config, err = applySearchSettings(config, variant.Settings)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("experiment %s: %v", exp.Name, err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if variant != nil {
+		requestSpan.setAttr("experiment", exp.Name)
+		requestSpan.setAttr("experiment.variant", variant.Name)
+	}
+	searchResults, err := performSearch(ctx, config.Index, searchTerm, config.Opts)
 	if err != nil {
+		requestSpan.setError(err)
+		status := http.StatusInternalServerError
+		var rejected *breakerError
+		var busy *indexBusyError
+		if errors.As(err, &rejected) {
+			status = rejected.status
+		} else if errors.As(err, &busy) {
+			status = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", "1")
+		}
+		http.Error(w, err.Error(), status)
+		// failed searches are recorded too, slow failures are the ones most
+		// worth looking into
+		recordSlowQuery(r, indexPath, searchTerm, config.Opts.Mode, 0, time.Since(start), searchTimings{}, status, err)
 		return
 	}
+	requestSpan.setAttr("search.hits", searchResults.Total)
+	entry := queryLogEntry{
+		Time:  time.Now(),
+		Index: indexPath,
+		Query: searchTerm,
+		Hits:  searchResults.Total,
+	}
+	if variant != nil {
+		entry.Experiment, entry.Variant = exp.Name, variant.Name
+	}
+	logQuery(entry)
 	// printStruct(searchResults)
 	// fmt.Printf("%v", searchResults)
 
@@ -89,61 +258,334 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	for i, hit := range searchResults.Hits {
 		hitResp[i].Name = hit.ID
 		hitResp[i].Line = hit.Fragments["Line"]
+		if passage, ok := searchResults.Aligned[hit.ID]; ok {
+			hitResp[i].Aligned = &passage
+		}
 	}
 
 	res := struct {
 		SearchStat string
 		Hits       []SearchRes
+		Experiment string `json:",omitempty"`
+		Variant    string `json:",omitempty"`
+		UID        string `json:",omitempty"` // to send back as the uid parameter
 	}{
 		SearchStat: fmt.Sprintf("%d results (%s)", searchResults.Total, searchResults.Took),
 		Hits:       hitResp,
+		Experiment: entry.Experiment,
+		Variant:    entry.Variant,
+		UID:        uid,
 	}
 
+	encodeStart := time.Now()
+	_, encodeSpan := startSpan(ctx, "encode")
 	jsonResponse, err := json.Marshal(res)
+	encodeSpan.setError(err)
+	encodeSpan.finish()
 	if err != nil {
+		requestSpan.setError(err)
 		log.Printf("JSON marshaling error: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	searchResults.Timings.Encode = time.Since(encodeStart)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(jsonResponse)
+
+	recordSlowQuery(r, indexPath, searchTerm, config.Opts.Mode, searchResults.Total, time.Since(start), searchResults.Timings,
+		http.StatusOK, nil)
 }
 
-func performSearch(indexPath string, searchTerm string) (*bleve.SearchResult, error) {
+// searchOptions are the optional parameters of a search
+type searchOptions struct {
+	// Lang analyzes the query with the analyzer of that language and only
+	// matches documents in it. Left empty, the language is detected from the
+	// query on indexes whose documents are tagged with their language.
+	Lang string
+
+	// Aligned attaches to each hit its counterpart passage in the edition
+	// in this language.
+	Aligned string
+
+	// Mode is how the query is read, match, phrase or query.
+	Mode string
+
+	// Profile names the ranking profile, the index's default profile is
+	// used when empty.
+	Profile string
+
+	// Size limits the number of hits, all of them are returned when 0.
+	Size int
+
+	// Fields are stored fields to load with the hits.
+	Fields []string
+
+	// SkipRerank leaves the hits in the order of their score, even when a
+	// learned ranking model is active.
+	SkipRerank bool
+}
+
+// searchConfig is a way of searching an index, compared by eval and split
+// traffic between by experiments
+type searchConfig struct {
+	Index string
+	Opts  searchOptions
+}
+
+func (c searchConfig) String() string {
+	s := c.Index
+	for _, kv := range [][2]string{{"mode", c.Opts.Mode}, {"profile", c.Opts.Profile}, {"lang", c.Opts.Lang}} {
+		if kv[1] != "" {
+			s += " " + kv[0] + "=" + kv[1]
+		}
+	}
+	if c.Opts.SkipRerank {
+		s += " ltr=off"
+	}
+	return s
+}
+
+// applySearchSettings sets the index, mode, profile, lang and ltr (on or off)
+// settings on top of base, and checks the result is a valid search.
+func applySearchSettings(base searchConfig, settings map[string]string) (searchConfig, error) {
+	config := base
+	for key, value := range settings {
+		switch key {
+		case "index":
+			config.Index = value
+		case "mode":
+			config.Opts.Mode = value
+		case "profile":
+			config.Opts.Profile = value
+		case "lang":
+			config.Opts.Lang = value
+		case "ltr":
+			if value != "on" && value != "off" {
+				return base, fmt.Errorf("ltr must be on or off, got %q", value)
+			}
+			config.Opts.SkipRerank = value == "off"
+		default:
+			return base, fmt.Errorf("unknown setting %q, expected index, mode, profile, lang or ltr", key)
+		}
+	}
+	if !validMode(config.Opts.Mode) {
+		return base, fmt.Errorf("unknown mode %q", config.Opts.Mode)
+	}
+	if config.Opts.Lang != "" && !supportedLanguage(config.Opts.Lang) {
+		return base, fmt.Errorf("unsupported language %q", config.Opts.Lang)
+	}
+	if _, err := rankingProfileFor(config.Index, config.Opts.Profile); err != nil {
+		return base, err
+	}
+	return config, nil
+}
+
+// searchResult is a bleve search result along with what the search options
+// added to it
+type searchResult struct {
+	*bleve.SearchResult
+
+	// Aligned maps hit IDs to their counterpart passages
+	Aligned map[string]alignedPassage
+
+	Timings searchTimings
+}
+
+// validateSearchOptions checks the options of a search on indexPath
+func validateSearchOptions(indexPath string, opts searchOptions) error {
+	if !validMode(opts.Mode) {
+		return fmt.Errorf("unknown mode %q", opts.Mode)
+	}
+	if _, err := rankingProfileFor(indexPath, opts.Profile); err != nil {
+		return err
+	}
+	for _, lang := range []string{opts.Lang, opts.Aligned} {
+		if lang != "" && !supportedLanguage(lang) {
+			return fmt.Errorf("unsupported language %q", lang)
+		}
+	}
+	return nil
+}
+
+func performSearch(ctx context.Context, indexPath string, searchTerm string, opts searchOptions) (*searchResult, error) {
 	log.Printf(`Searching through index "%s" for "%s"`, indexPath, searchTerm)
 
-	path := *dataDir + string(os.PathSeparator) + indexPath
-	index, err := bleve.Open(path)
+	start := time.Now()
+	_, lookupSpan := startSpan(ctx, "index.lookup")
+	lookupSpan.setAttr("search.index", indexPath)
+	index, release, err := acquireIndex(indexPath)
+	lookupSpan.setError(err)
+	lookupSpan.finish()
 	if err != nil {
 		log.Printf("error opening index %s: %v", indexPath, err)
 		return nil, err
 	}
+	defer release()
+	timings := searchTimings{Open: time.Since(start)}
+
+	start = time.Now()
+	_, buildSpan := startSpan(ctx, "query.build")
+	profile, err := rankingProfileFor(indexPath, opts.Profile)
+	if err != nil {
+		buildSpan.setError(err)
+		buildSpan.finish()
+		return nil, err
+	}
+	indexQuery := buildSearchQuery(index, searchTerm, opts, profile)
+	buildSpan.finish()
+
+	var model *ltrModel
+	if !opts.SkipRerank {
+		model = activeLTRModel()
+	}
+
+	var prior *positionalPrior
+	if profile != nil {
+		prior = profile.PositionalPrior
+	}
 
-	indexQuery := bleve.NewMatchQuery(searchTerm)
 	searchReq := bleve.NewSearchRequest(indexQuery)
 	searchReq.Size = math.MaxInt64
-	searchReq.Highlight = bleve.NewHighlight()
-	searchResults, err := index.Search(searchReq)
+	if opts.Size > 0 {
+		searchReq.Size = opts.Size
+		// rerank as many hits as without a size limit, and let the prior
+		// promote hits from below the size
+		if model != nil && searchReq.Size < *ltrTopN {
+			searchReq.Size = *ltrTopN
+		}
+		if prior != nil && searchReq.Size < *priorTopN {
+			searchReq.Size = *priorTopN
+		}
+	}
+	// hits are highlighted after the search, from the stored Line, to tell
+	// the time highlighting takes apart
+	searchReq.IncludeLocations = true
+	searchReq.Fields = append(searchReq.Fields, "Line")
+	searchReq.Fields = append(searchReq.Fields, opts.Fields...)
+	if opts.Aligned != "" {
+		searchReq.Fields = append(searchReq.Fields, alignedField+"."+opts.Aligned, languageField)
+	}
+	if prior != nil && prior.Field != "" {
+		searchReq.Fields = append(searchReq.Fields, prior.Field)
+	}
+	if err := checkBreaker(indexPath, indexQuery, searchReq.Size); err != nil {
+		return nil, err
+	}
+	searchCtx, searchSpan := startSpan(ctx, "index.Search")
+	searchResults, err := index.SearchInContext(searchCtx, searchReq)
 	if err != nil {
+		searchSpan.setError(err)
+		searchSpan.finish()
 		log.Printf("index search error: %v", err)
 		return nil, err
 	}
+	searchSpan.setAttr("search.hits", searchResults.Total)
+	searchSpan.finish()
+	if prior != nil {
+		applyPositionalPrior(searchResults, prior)
+	}
+	if model != nil {
+		_, rerankSpan := startSpan(ctx, "rerank")
+		rerank(model, searchTerm, searchResults, *ltrTopN)
+		rerankSpan.finish()
+	}
+	if opts.Size > 0 && len(searchResults.Hits) > opts.Size {
+		searchResults.Hits = searchResults.Hits[:opts.Size]
+	}
+
+	res := &searchResult{SearchResult: searchResults}
+	if opts.Aligned != "" {
+		_, alignSpan := startSpan(ctx, "align")
+		res.Aligned, err = alignHits(index, searchResults.Hits, opts.Aligned)
+		alignSpan.setError(err)
+		alignSpan.finish()
+		if err != nil {
+			log.Printf("alignment lookup error: %v", err)
+			return nil, err
+		}
+	}
+	timings.Search = time.Since(start)
 
-	err = index.Close()
+	start = time.Now()
+	_, highlightSpan := startSpan(ctx, "highlight")
+	err = highlightHits(searchResults.Hits, "Line")
+	highlightSpan.setError(err)
+	highlightSpan.finish()
 	if err != nil {
-		log.Printf("close index error: %v", err)
+		log.Printf("highlighting error: %v", err)
 		return nil, err
 	}
+	timings.Highlight = time.Since(start)
+	res.Timings = timings
+	return res, nil
+}
 
-	return searchResults, nil
+// highlightHits sets the fragments of field of hits that were loaded with
+// their term locations and the stored field, like bleve does when a search
+// request asks for highlighting.
+func highlightHits(hits search.DocumentMatchCollection, field string) error {
+	highlighter, err := bleve.Config.Cache.HighlighterNamed(bleve.Config.DefaultHighlighter)
+	if err != nil {
+		return err
+	}
+	for _, hit := range hits {
+		var values []interface{}
+		switch v := hit.Fields[field].(type) {
+		case string:
+			values = []interface{}{v}
+		case []interface{}:
+			values = v
+		}
+		doc := document.NewDocument(hit.ID)
+		for i, v := range values {
+			text, ok := v.(string)
+			if !ok {
+				continue
+			}
+			var arrayPositions []uint64
+			if len(values) > 1 {
+				arrayPositions = []uint64{uint64(i)}
+			}
+			doc.AddField(document.NewTextField(field, arrayPositions, []byte(text)))
+		}
+		highlighter.BestFragmentsInField(hit, doc, field, 1)
+	}
+	return nil
+}
+
+// buildSearchQuery turns the q parameter into the query run against index,
+// taking the language of the query into account on indexes of documents
+// tagged with their language. An explicit lang only searches documents
+// tagged with it.
+func buildSearchQuery(index bleve.Index, searchTerm string, opts searchOptions, profile *rankingProfile) query.Query {
+	if opts.Lang != "" {
+		return languageFilter(textQuery(searchTerm, opts.Mode, opts.Lang, profile), opts.Lang)
+	}
+	langs := indexLanguages(index)
+	if len(langs) == 0 {
+		return textQuery(searchTerm, opts.Mode, "", profile)
+	}
+	// documents whose language couldn't be detected are searched too
+	untagged := withoutLanguage(textQuery(searchTerm, opts.Mode, "", profile), langs)
+	if detected, ok := detectTextLanguage(searchTerm, 1); ok {
+		return bleve.NewDisjunctionQuery(
+			languageFilter(textQuery(searchTerm, opts.Mode, detected, profile), detected), untagged)
+	}
+
+	// search every language with its own analyzer
+	disjuncts := make([]query.Query, len(langs), len(langs)+1)
+	for i, lang := range langs {
+		disjuncts[i] = languageFilter(textQuery(searchTerm, opts.Mode, lang, profile), lang)
+	}
+	return bleve.NewDisjunctionQuery(append(disjuncts, untagged)...)
 }
 
 func addCorsHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, traceparent")
 
 		if r.Method == http.MethodOptions {
 			// Handle preflight requests
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var slowQueryThreshold = flag.Duration("slowQueryThreshold", 0,
+	"searches taking longer than this are recorded as slow queries, 0 turns slow query recording off")
+var slowQueryLogPath = flag.String("slowQueryLog", "",
+	"optional path of a file to append slow queries to, one JSON object per line")
+
+// searchTimings breaks down where the time of a search went
+type searchTimings struct {
+	Open      time.Duration // getting hold of the index, opening it if it wasn't resident
+	Search    time.Duration // running the query, reranking and aligning the hits
+	Highlight time.Duration
+	Encode    time.Duration // marshaling the response
+}
+
+// slowQueryTimings are the timings of a slow query in milliseconds
+type slowQueryTimings struct {
+	Total     float64 `json:"total"`
+	Open      float64 `json:"open"`
+	Search    float64 `json:"search"`
+	Highlight float64 `json:"highlight"`
+	Encode    float64 `json:"encode"`
+}
+
+type slowQueryEntry struct {
+	Time    time.Time         `json:"time"`
+	Index   string            `json:"index"`
+	Query   string            `json:"q"`
+	Mode    string            `json:"mode"`
+	Params  map[string]string `json:"params"`
+	Hits    uint64            `json:"hits"`
+	Status  int               `json:"status"`
+	Error   string            `json:"error,omitempty"`
+	Timings slowQueryTimings  `json:"ms"`
+}
+
+// slowQueryStat aggregates the slow runs of one query
+type slowQueryStat struct {
+	Index   string
+	Query   string
+	Count   int
+	TotalMs float64 `json:"-"`
+	MeanMs  float64
+	MaxMs   float64
+}
+
+const (
+	// slowestKept is the number of slowest queries the summary shows
+	slowestKept = 20
+	// maxSlowQueryStats caps the distinct queries aggregated, slow queries
+	// beyond it are counted but not aggregated
+	maxSlowQueryStats = 10000
+)
+
+var slowQueries = struct {
+	sync.Mutex
+	enc     *json.Encoder
+	count   int
+	byIndex map[string]int
+	slowest []slowQueryEntry
+	stats   map[[2]string]*slowQueryStat
+}{
+	byIndex: map[string]int{},
+	stats:   map[[2]string]*slowQueryStat{},
+}
+
+func openSlowQueryLog() error {
+	if *slowQueryLogPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*slowQueryLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	slowQueries.enc = json.NewEncoder(f)
+	return nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// recordSlowQuery writes a search that took longer than the threshold to the
+// slow query log and adds it to the summary, with the status it was answered
+// with and, when it failed, its error.
+func recordSlowQuery(r *http.Request, indexName string, searchTerm string, mode string, hits uint64,
+	total time.Duration, timings searchTimings, status int, searchErr error) {
+	if *slowQueryThreshold <= 0 || total < *slowQueryThreshold {
+		return
+	}
+	if mode == "" {
+		mode = modeMatch
+	}
+	params := map[string]string{}
+	for name, values := range r.URL.Query() {
+		params[name] = values[0]
+	}
+	entry := slowQueryEntry{
+		Time:   time.Now(),
+		Index:  indexName,
+		Query:  searchTerm,
+		Mode:   mode,
+		Params: params,
+		Hits:   hits,
+		Status: status,
+		Timings: slowQueryTimings{
+			Total:     milliseconds(total),
+			Open:      milliseconds(timings.Open),
+			Search:    milliseconds(timings.Search),
+			Highlight: milliseconds(timings.Highlight),
+			Encode:    milliseconds(timings.Encode),
+		},
+	}
+
+	if searchErr != nil {
+		entry.Error = searchErr.Error()
+	}
+
+	slowQueries.Lock()
+	defer slowQueries.Unlock()
+	if slowQueries.enc != nil {
+		if err := slowQueries.enc.Encode(entry); err != nil {
+			log.Printf("slow query log write error: %v", err)
+		}
+	} else {
+		log.Printf("slow query on %s took %s, status %d: %q", indexName, total, status, searchTerm)
+	}
+
+	slowQueries.count++
+	slowQueries.byIndex[indexName]++
+	slowQueries.slowest = append(slowQueries.slowest, entry)
+	sort.SliceStable(slowQueries.slowest, func(i, j int) bool {
+		return slowQueries.slowest[i].Timings.Total > slowQueries.slowest[j].Timings.Total
+	})
+	if len(slowQueries.slowest) > slowestKept {
+		slowQueries.slowest = slowQueries.slowest[:slowestKept]
+	}
+
+	key := [2]string{indexName, searchTerm}
+	stat, ok := slowQueries.stats[key]
+	if !ok {
+		if len(slowQueries.stats) >= maxSlowQueryStats {
+			return
+		}
+		stat = &slowQueryStat{Index: indexName, Query: searchTerm}
+		slowQueries.stats[key] = stat
+	}
+	stat.Count++
+	stat.TotalMs += entry.Timings.Total
+	if entry.Timings.Total > stat.MaxMs {
+		stat.MaxMs = entry.Timings.Total
+	}
+}
+
+// slowQueriesHandler serves GET /admin/slowlog, a summary of the slow
+// queries since the server started: how many per index, the slowest ones
+// with their timings and the queries that were slow most often.
+func slowQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	slowQueries.Lock()
+	res := struct {
+		Threshold string
+		Count     int
+		ByIndex   map[string]int
+		Slowest   []slowQueryEntry
+		Frequent  []slowQueryStat
+	}{
+		Threshold: slowQueryThreshold.String(),
+		Count:     slowQueries.count,
+		ByIndex:   map[string]int{},
+		Slowest:   append([]slowQueryEntry{}, slowQueries.slowest...),
+	}
+	for indexName, n := range slowQueries.byIndex {
+		res.ByIndex[indexName] = n
+	}
+	for _, stat := range slowQueries.stats {
+		s := *stat
+		s.MeanMs = s.TotalMs / float64(s.Count)
+		res.Frequent = append(res.Frequent, s)
+	}
+	slowQueries.Unlock()
+
+	sort.Slice(res.Frequent, func(i, j int) bool {
+		if res.Frequent[i].Count != res.Frequent[j].Count {
+			return res.Frequent[i].Count > res.Frequent[j].Count
+		}
+		return res.Frequent[i].MaxMs > res.Frequent[j].MaxMs
+	})
+	if len(res.Frequent) > slowestKept {
+		res.Frequent = res.Frequent[:slowestKept]
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var traceExporter = flag.String("traceExporter", "",
+	"where to export trace spans to: otlp (OTLP/HTTP JSON), file, or nothing when empty")
+var traceEndpoint = flag.String("traceEndpoint", "http://localhost:4318/v1/traces",
+	"OTLP/HTTP traces endpoint of the otlp exporter")
+var traceFilePath = flag.String("traceFile", "traces.jsonl",
+	"file the file exporter appends batches of spans to, one OTLP JSON request per line")
+var traceServiceName = flag.String("traceServiceName", "document-search", "service.name of the exported spans")
+
+// span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// span is a timed phase of a request. Its methods do nothing on a nil span,
+// which is what startSpan returns when tracing is off.
+type span struct {
+	name     string
+	kind     int
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      error
+}
+
+// remoteParent is the caller's span, from a W3C traceparent header
+type remoteParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+type spanKey struct{}
+type remoteParentKey struct{}
+
+var tracer struct {
+	spans chan *span
+}
+
+// startTracing starts the exporter, spans are only recorded once it runs
+func startTracing() error {
+	var export func([]byte) error
+	switch *traceExporter {
+	case "":
+		return nil
+	case "otlp":
+		client := &http.Client{Timeout: 10 * time.Second}
+		export = func(body []byte) error {
+			resp, err := client.Post(*traceEndpoint, "application/json", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				return fmt.Errorf("%s: %s", *traceEndpoint, resp.Status)
+			}
+			return nil
+		}
+	case "file":
+		f, err := os.OpenFile(*traceFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		export = func(body []byte) error {
+			_, err := f.Write(append(body, '\n'))
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown trace exporter %q, expected otlp or file", *traceExporter)
+	}
+
+	tracer.spans = make(chan *span, 4096)
+	go exportSpans(export)
+	log.Printf("exporting traces with the %s exporter", *traceExporter)
+	return nil
+}
+
+// exportSpans sends the finished spans in batches, every few seconds or
+// whenever enough of them piled up.
+func exportSpans(export func([]byte) error) {
+	const maxBatch = 512
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []*span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		body, err := json.Marshal(otlpRequest(batch))
+		if err == nil {
+			err = export(body)
+		}
+		if err != nil {
+			log.Printf("error exporting %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-tracer.spans:
+			batch = append(batch, s)
+			if len(batch) >= maxBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// extractTraceContext returns a context carrying the span of the caller, when
+// the request has a valid traceparent header whose sampled flag is set.
+// Requests that carry one that isn't sampled aren't traced either.
+func extractTraceContext(r *http.Request) (context.Context, bool) {
+	ctx := r.Context()
+	header := r.Header.Get("traceparent")
+	if header == "" {
+		return ctx, true
+	}
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx, true
+	}
+	var parent remoteParent
+	_, err1 := hex.Decode(parent.traceID[:], []byte(parts[1]))
+	_, err2 := hex.Decode(parent.spanID[:], []byte(parts[2]))
+	flags, err3 := strconv.ParseUint(parts[3], 16, 8)
+	if err1 != nil || err2 != nil || err3 != nil || parent.traceID == [16]byte{} || parent.spanID == [8]byte{} {
+		return ctx, true
+	}
+	return context.WithValue(ctx, remoteParentKey{}, parent), flags&1 == 1
+}
+
+// startRequestSpan starts the server span of an HTTP request, continuing the
+// trace of the caller if it sent one.
+func startRequestSpan(r *http.Request, name string) (context.Context, *span) {
+	ctx, sampled := extractTraceContext(r)
+	if !sampled {
+		// a nil span keeps the phases of the request from being recorded
+		return context.WithValue(ctx, spanKey{}, (*span)(nil)), nil
+	}
+	ctx, s := startSpan(ctx, name)
+	if s != nil {
+		s.kind = spanKindServer
+		s.setAttr("http.method", r.Method)
+		s.setAttr("http.target", r.URL.Path)
+	}
+	return ctx, s
+}
+
+// startSpan starts a span as a child of the one in ctx, or of the remote
+// parent from the traceparent header, or as the root of a new trace. It
+// returns nil when tracing is off or the request isn't sampled.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if tracer.spans == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: spanKindInternal, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		if parent == nil {
+			return ctx, nil
+		}
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else if parent, ok := ctx.Value(remoteParentKey{}).(remoteParent); ok {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = map[string]interface{}{}
+	}
+	s.attrs[key] = value
+}
+
+func (s *span) setError(err error) {
+	if s == nil {
+		return
+	}
+	s.err = err
+}
+
+// finish ends the span and hands it to the exporter, dropping it when the
+// exporter falls behind rather than slowing the request down.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case tracer.spans <- s:
+	default:
+	}
+}
+
+// otlpRequest builds the OTLP/JSON ExportTraceServiceRequest of a batch
+func otlpRequest(spans []*span) interface{} {
+	otlpSpans := make([]interface{}, len(spans))
+	for i, s := range spans {
+		otlpSpan := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			otlpSpan["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			otlpSpan["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+		}
+		otlpSpans[i] = otlpSpan
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": *traceServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "document-search-demo"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	rv := []interface{}{}
+	for key, value := range attrs {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": value}
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case uint64:
+			v = map[string]interface{}{"intValue": strconv.FormatUint(value, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		rv = append(rv, map[string]interface{}{"key": key, "value": v})
+	}
+	return rv
+}
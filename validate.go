@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+type validateRequest struct {
+	Index   string `json:"index"`
+	Query   string `json:"q"`
+	Lang    string `json:"lang"`
+	Mode    string `json:"mode"`
+	Profile string `json:"profile"`
+}
+
+// analyzedText is the text of a match or phrase clause and the terms the
+// analyzer turned it into
+type analyzedText struct {
+	Field    string
+	Analyzer string
+	Text     string
+	Tokens   []string
+}
+
+type validateResponse struct {
+	Valid    bool
+	Error    string         `json:",omitempty"`
+	Query    query.Query    `json:",omitempty"`
+	Tokens   []analyzedText `json:",omitempty"`
+	Cost     *queryCost     `json:",omitempty"`
+	Warnings []string       `json:",omitempty"`
+}
+
+// validateHandler serves POST /validate, a dry run of a search. It takes
+// {"index":..., "q":..., "lang":..., "mode":..., "profile":...}, builds the
+// query like /search does, outside of any experiment, and returns the query
+// tree with query strings parsed, the analyzed text of every clause, the
+// estimated cost and warnings about clauses that can't match. Invalid
+// queries are reported with Valid false and the error.
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req validateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Index == "" {
+		http.Error(w, "invalid request: index is required", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, validateSearch(req))
+}
+
+func validateSearch(req validateRequest) validateResponse {
+	invalid := func(err error) validateResponse {
+		return validateResponse{Error: err.Error()}
+	}
+
+	opts := searchOptions{Lang: req.Lang, Mode: req.Mode, Profile: req.Profile}
+	if err := validateSearchOptions(req.Index, opts); err != nil {
+		return invalid(err)
+	}
+	profile, err := rankingProfileFor(req.Index, opts.Profile)
+	if err != nil {
+		return invalid(err)
+	}
+	index, release, err := acquireIndex(req.Index)
+	if err != nil {
+		return invalid(err)
+	}
+	defer release()
+
+	q, err := parseQueryStrings(buildSearchQuery(index, req.Query, opts, profile))
+	if err != nil {
+		return invalid(err)
+	}
+	if v, ok := q.(query.ValidatableQuery); ok {
+		if err := v.Validate(); err != nil {
+			return invalid(err)
+		}
+	}
+	res := validateResponse{Valid: true, Query: q}
+
+	fields, err := indexFields(req.Index)
+	if err != nil {
+		return invalid(err)
+	}
+	// an alias over several indexes has no mapping of its own, the clauses
+	// are analyzed the way each of its indexes analyzes them
+	var mappings []mapping.IndexMapping
+	for _, target := range resolveIndex(req.Index) {
+		targetIndex, release, err := indexes.Acquire(target)
+		if err != nil {
+			return invalid(err)
+		}
+		mappings = append(mappings, targetIndex.Mapping())
+		release()
+	}
+	warned := map[string]bool{}
+	warn := func(format string, args ...interface{}) {
+		warning := fmt.Sprintf(format, args...)
+		if !warned[warning] {
+			warned[warning] = true
+			res.Warnings = append(res.Warnings, warning)
+		}
+	}
+	seen := map[[3]string]bool{}
+	walkQuery(q, func(q query.Query) {
+		var queryField, text, queryAnalyzer string
+		switch q := q.(type) {
+		case *query.MatchQuery:
+			queryField, text, queryAnalyzer = q.FieldVal, q.Match, q.Analyzer
+		case *query.MatchPhraseQuery:
+			queryField, text, queryAnalyzer = q.FieldVal, q.MatchPhrase, q.Analyzer
+		case *query.PhraseQuery:
+			queryField = q.Field
+		case *query.MultiPhraseQuery:
+			queryField = q.Field
+		case query.FieldableQuery:
+			queryField = q.Field()
+		default:
+			return
+		}
+		for _, m := range mappings {
+			field, analyzerName := queryField, queryAnalyzer
+			if field == "" {
+				field = m.DefaultSearchField()
+			}
+			if !fields[field] {
+				warn("field %s is not in the index", field)
+			}
+			if text == "" {
+				continue
+			}
+
+			if analyzerName == "" {
+				analyzerName = m.AnalyzerNameForPath(field)
+			}
+			key := [3]string{field, analyzerName, text}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			analyzed := analyzedText{
+				Field:    field,
+				Analyzer: analyzerName,
+				Text:     text,
+				Tokens:   analyzeText(m, text, field, analyzerName),
+			}
+			if analyzed.Tokens == nil {
+				analyzed.Tokens = []string{}
+			}
+			res.Tokens = append(res.Tokens, analyzed)
+			if len(analyzed.Tokens) == 0 && strings.TrimSpace(text) != "" {
+				warn("%q is only stop words or punctuation to the %s analyzer of %s, it matches nothing", text, analyzerName, field)
+			}
+		}
+	})
+	if strings.TrimSpace(req.Query) == "" {
+		warn("the query is empty, it matches nothing")
+	}
+
+	cost, err := estimateCost(req.Index, q)
+	if err != nil {
+		return invalid(err)
+	}
+	res.Cost = &cost
+	if *maxQueryTerms > 0 && cost.Terms > *maxQueryTerms {
+		warn("the query expands to %d terms, searches over %d are rejected", cost.Terms, *maxQueryTerms)
+	}
+	if *maxQueryHits > 0 && cost.Candidates > *maxQueryHits {
+		warn("the query may return %d hits, searches over %d are rejected unless they ask for fewer", cost.Candidates, *maxQueryHits)
+	}
+	return res
+}
+
+// parseQueryStrings replaces the query string queries of q by the queries
+// they parse into, so that the tree shows what actually runs
+func parseQueryStrings(q query.Query) (query.Query, error) {
+	var err error
+	parseAll := func(queries []query.Query) []query.Query {
+		parsed := make([]query.Query, len(queries))
+		for i, q := range queries {
+			if parsed[i], err = parseQueryStrings(q); err != nil {
+				return nil
+			}
+		}
+		return parsed
+	}
+	switch q := q.(type) {
+	case *query.QueryStringQuery:
+		parsed, err := q.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("parsing query string %q: %v", q.Query, err)
+		}
+		return parseQueryStrings(parsed)
+	case *query.ConjunctionQuery:
+		c := *q
+		c.Conjuncts = parseAll(q.Conjuncts)
+		return &c, err
+	case *query.DisjunctionQuery:
+		d := *q
+		d.Disjuncts = parseAll(q.Disjuncts)
+		return &d, err
+	case *query.BooleanQuery:
+		b := *q
+		for _, clause := range []*query.Query{&b.Must, &b.Should, &b.MustNot} {
+			if *clause == nil {
+				continue
+			}
+			if *clause, err = parseQueryStrings(*clause); err != nil {
+				return nil, err
+			}
+		}
+		return &b, nil
+	}
+	return q, nil
+}
+
+// walkQuery calls fn on q and every query nested in it
+func walkQuery(q query.Query, fn func(query.Query)) {
+	if q == nil {
+		return
+	}
+	fn(q)
+	switch q := q.(type) {
+	case *query.ConjunctionQuery:
+		for _, c := range q.Conjuncts {
+			walkQuery(c, fn)
+		}
+	case *query.DisjunctionQuery:
+		for _, d := range q.Disjuncts {
+			walkQuery(d, fn)
+		}
+	case *query.BooleanQuery:
+		walkQuery(q.Must, fn)
+		walkQuery(q.Should, fn)
+		walkQuery(q.MustNot, fn)
+	}
+}
+
+// indexFields returns the fields indexed in the index or alias named
+// indexName, in any of the indexes an alias points to
+func indexFields(indexName string) (map[string]bool, error) {
+	fields := map[string]bool{}
+	for _, target := range resolveIndex(indexName) {
+		index, release, err := indexes.Acquire(target)
+		if err != nil {
+			return nil, err
+		}
+		names, err := index.Fields()
+		release()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			fields[name] = true
+		}
+	}
+	return fields, nil
+}
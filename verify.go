@@ -0,0 +1,546 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/blevesearch/bleve/v2/index/scorch"
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxSegmentProblems caps the problems reported per segment, or for the root
+// bolt file, a damaged file tends to fail every check in the same way
+const maxSegmentProblems = 10
+
+// exitBoltInUse is the exit status of verify -checkBolt when another process
+// holds the bolt file
+const exitBoltInUse = 3
+
+const (
+	remedyRestore = "restore the index from a backup or extract it again from data.tar.gz, " +
+		"or rebuild it from a readable copy with the reindex command"
+	remedyOrphan = "harmless, scorch left it behind after a crash or it came with a bad copy; " +
+		"delete it while the index is closed to free the space"
+)
+
+type verifyProblem struct {
+	Severity string // error, or warning for problems that lose no data
+	Where    string
+	Problem  string
+	Remedy   string
+}
+
+type verifySegment struct {
+	File     string
+	Docs     uint64 // deleted ones included
+	Deleted  uint64
+	Fields   int
+	Terms    uint64
+	Postings uint64
+}
+
+type verifyReport struct {
+	Index     string
+	OK        bool
+	InUse     bool // held by another process, so left unchecked
+	Snapshots int
+	Docs      uint64
+	Segments  []verifySegment
+	Problems  []verifyProblem
+	Took      string
+}
+
+func (r *verifyReport) problem(severity string, where string, remedy string, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, verifyProblem{
+		Severity: severity,
+		Where:    where,
+		Problem:  fmt.Sprintf(format, args...),
+		Remedy:   remedy,
+	})
+}
+
+// inUse records that another process holds the index, which is not damage
+// but leaves it unchecked
+func (r *verifyReport) inUse() {
+	r.InUse = true
+	r.problem("warning", "index", fmt.Sprintf("use GET /admin/verify/%s on that server", r.Index),
+		"in use by a running server, or another process, so it was not checked")
+}
+
+// verifyIndex checks the index at path, which nothing may have open: the
+// root bolt file with its snapshots, then every segment of the current
+// snapshot, reading each term dictionary with its postings and the stored
+// fields of each live document.
+func verifyIndex(name string, path string) (report verifyReport) {
+	start := time.Now()
+	report.Index = name
+	defer func() {
+		report.OK = !report.InUse
+		for _, p := range report.Problems {
+			if p.Severity == "error" {
+				report.OK = false
+			}
+		}
+		report.Took = time.Since(start).Round(time.Millisecond).String()
+	}()
+
+	data, err := ioutil.ReadFile(filepath.Join(path, "index_meta.json"))
+	if err != nil {
+		report.problem("error", "index_meta.json", remedyRestore, "unreadable: %v", err)
+		return report
+	}
+	var meta struct {
+		IndexType string `json:"index_type"`
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		report.problem("error", "index_meta.json", remedyRestore, "not valid JSON: %v", err)
+		return report
+	}
+	if meta.IndexType != scorch.Name {
+		report.problem("warning", "index_meta.json", "",
+			"%s index, only scorch indexes are checked beyond opening them", meta.IndexType)
+		verifyOpen(&report, path)
+		return report
+	}
+
+	if !verifyRootBolt(&report, filepath.Join(path, "store")) {
+		return report
+	}
+	verifyOpen(&report, path)
+	return report
+}
+
+// verifyRootBolt checks the pages of root.bolt, then that the segment files
+// its snapshots list exist and that every segment file belongs to one. It
+// returns false when the index can't be opened to check further.
+func verifyRootBolt(report *verifyReport, storePath string) bool {
+	boltPath := filepath.Join(storePath, "root.bolt")
+	problems, err := checkBoltPagesInChild(boltPath)
+	if _, ok := err.(*indexInUseError); ok {
+		report.inUse()
+		return false
+	}
+	if err != nil {
+		report.problem("error", "root.bolt", remedyRestore, "%v", err)
+		return false
+	}
+	for i, problem := range problems {
+		if i == maxSegmentProblems {
+			report.problem("error", "root.bolt", remedyRestore, "and %d more problems", len(problems)-i)
+			break
+		}
+		report.problem("error", "root.bolt", remedyRestore, "%s", problem)
+	}
+	if len(problems) > 0 {
+		return false
+	}
+
+	db, err := bolt.Open(boltPath, 0600, &bolt.Options{ReadOnly: true, Timeout: boltTimeout})
+	if err == bolt.ErrTimeout {
+		report.inUse()
+		return false
+	}
+	if err != nil {
+		report.problem("error", "root.bolt", remedyRestore, "cannot open: %v", err)
+		return false
+	}
+	defer db.Close()
+
+	referenced := map[string]bool{}
+	err = db.View(func(tx *bolt.Tx) error {
+		snapshots := tx.Bucket([]byte{'s'})
+		if snapshots == nil {
+			return nil
+		}
+		var epochs [][]byte
+		snapshots.ForEach(func(k, _ []byte) error {
+			epochs = append(epochs, k)
+			return nil
+		})
+		report.Snapshots = len(epochs)
+		for i, epoch := range epochs {
+			snapshot := snapshots.Bucket(epoch)
+			if snapshot == nil {
+				continue
+			}
+			latest := i == len(epochs)-1
+			snapshot.ForEach(func(k, _ []byte) error {
+				segment := snapshot.Bucket(k)
+				// the i and m buckets hold internal values and metadata
+				if segment == nil || string(k) == "i" || string(k) == "m" {
+					return nil
+				}
+				file := string(segment.Get([]byte{'p'}))
+				if file == "" || referenced[file] {
+					return nil
+				}
+				referenced[file] = true
+				if _, err := os.Stat(filepath.Join(storePath, file)); err == nil {
+					return nil
+				}
+				if latest {
+					report.problem("error", file, remedyRestore,
+						"segment of the current snapshot is missing, the index opens an older snapshot, "+
+							"without the documents added since, or not at all")
+				} else {
+					report.problem("warning", file, "harmless, scorch drops the old snapshot once it is no longer needed",
+						"segment of an old snapshot is missing")
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		report.problem("error", "root.bolt", remedyRestore, "cannot read snapshots: %v", err)
+		return false
+	}
+
+	entries, err := ioutil.ReadDir(storePath)
+	if err != nil {
+		report.problem("error", "store", remedyRestore, "cannot list segment files: %v", err)
+		return false
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".zap") && !referenced[entry.Name()] {
+			report.problem("warning", entry.Name(), remedyOrphan,
+				"segment file of %d bytes belongs to no snapshot", entry.Size())
+		}
+	}
+	return true
+}
+
+// checkBoltPagesInChild checks the pages of a bolt file in a child process,
+// running verify -checkBolt, since bbolt faults on some kinds of damage
+// rather than reporting them. It returns the problems found.
+func checkBoltPagesInChild(path string) ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(exe, "verify", "-checkBolt", path).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == exitBoltInUse {
+		return nil, &indexInUseError{path}
+	} else if ok && exitErr.ExitCode() != 1 {
+		firstLine := strings.SplitN(strings.TrimSpace(string(exitErr.Stderr)), "\n", 2)[0]
+		return nil, fmt.Errorf("damaged badly enough that checking it crashed: %s", firstLine)
+	} else if err != nil && !ok {
+		return nil, err
+	}
+	var problems []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, nil
+}
+
+// checkBoltPages prints the problems tx.Check finds in a bolt file, one per
+// line, and returns the exit status of verify -checkBolt
+func checkBoltPages(path string) int {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: boltTimeout})
+	if err == bolt.ErrTimeout {
+		return exitBoltInUse
+	}
+	if err != nil {
+		fmt.Printf("cannot open: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	status := 0
+	db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			fmt.Println(err)
+			status = 1
+		}
+		return nil
+	})
+	return status
+}
+
+// verifyOpen opens the index read only and walks the segments of its
+// current snapshot
+func verifyOpen(report *verifyReport, path string) {
+	index, err := openExisting(path, true)
+	if _, ok := err.(*indexInUseError); ok {
+		report.inUse()
+		return
+	}
+	if err != nil {
+		report.problem("error", "index", remedyRestore, "cannot open: %v", err)
+		return
+	}
+	defer index.Close()
+
+	docCount, err := index.DocCount()
+	if err != nil {
+		report.problem("error", "index", remedyRestore, "cannot count documents: %v", err)
+		return
+	}
+	report.Docs = docCount
+
+	advanced, err := index.Advanced()
+	if err != nil {
+		report.problem("error", "index", remedyRestore, "%v", err)
+		return
+	}
+	reader, err := advanced.Reader()
+	if err != nil {
+		report.problem("error", "index", remedyRestore, "cannot read the current snapshot: %v", err)
+		return
+	}
+	defer reader.Close()
+	snapshot, ok := reader.(*scorch.IndexSnapshot)
+	if !ok {
+		return
+	}
+
+	for i, s := range snapshot.Segments() {
+		// the count of the snapshot leaves out deleted documents, which
+		// still have their numbers and postings
+		seg := verifySegment{File: fmt.Sprintf("segment %d", i), Docs: s.Segment().Count()}
+		if p, ok := s.Segment().(interface{ Path() string }); ok {
+			seg.File = filepath.Base(p.Path())
+		}
+		if deleted := s.Deleted(); deleted != nil {
+			seg.Deleted = deleted.GetCardinality()
+		}
+		verifySegmentSnapshot(report, s, &seg)
+		report.Segments = append(report.Segments, seg)
+	}
+}
+
+// verifySegmentSnapshot reads every term dictionary of a segment with the
+// postings of each term, and the stored fields of every live document
+func verifySegmentSnapshot(report *verifyReport, s *scorch.SegmentSnapshot, seg *verifySegment) {
+	problems := 0
+	fail := func(format string, args ...interface{}) bool {
+		problems++
+		if problems <= maxSegmentProblems {
+			report.problem("error", seg.File, remedyRestore, format, args...)
+		}
+		return problems < maxSegmentProblems
+	}
+	// zap trusts its files and panics on some kinds of damage
+	defer func() {
+		if r := recover(); r != nil {
+			fail("reading the segment crashed: %v", r)
+		}
+	}()
+
+	segment := s.Segment()
+	fields := segment.Fields()
+	seg.Fields = len(fields)
+	for _, field := range fields {
+		dict, err := segment.Dictionary(field)
+		if err != nil {
+			if !fail("dictionary of field %s is unreadable: %v", field, err) {
+				return
+			}
+			continue
+		}
+		var fieldTerms uint64
+		terms := dict.AutomatonIterator(nil, nil, nil)
+		for {
+			entry, err := terms.Next()
+			if err != nil {
+				if !fail("dictionary of field %s is unreadable after %d terms: %v", field, seg.Terms, err) {
+					return
+				}
+				break
+			}
+			if entry == nil {
+				break
+			}
+			seg.Terms++
+			fieldTerms++
+
+			postings, err := dict.PostingsList([]byte(entry.Term), nil, nil)
+			if err != nil {
+				if !fail("postings of %s:%q are unreadable: %v", field, entry.Term, err) {
+					return
+				}
+				continue
+			}
+			var n uint64
+			it := postings.Iterator(false, false, false, nil)
+			for {
+				posting, err := it.Next()
+				if err != nil {
+					if !fail("postings of %s:%q are unreadable after %d documents: %v", field, entry.Term, n, err) {
+						return
+					}
+					break
+				}
+				if posting == nil {
+					break
+				}
+				n++
+				if posting.Number() >= seg.Docs {
+					if !fail("postings of %s:%q point past the last document", field, entry.Term) {
+						return
+					}
+					break
+				}
+			}
+			seg.Postings += n
+			// the count of the dictionary entry can't be trusted, zap's
+			// iterator carries it over from the previous term at times
+			if count := postings.Count(); n != count {
+				if !fail("%s:%q has %d postings but its list counts %d", field, entry.Term, n, count) {
+					return
+				}
+			}
+		}
+		// every document, deleted or not, has an ID of its own
+		if field == "_id" && fieldTerms != seg.Docs {
+			if !fail("segment counts %d documents but has %d IDs", seg.Docs, fieldTerms) {
+				return
+			}
+		}
+	}
+
+	deleted := s.Deleted()
+	for num := uint64(0); num < seg.Docs; num++ {
+		if deleted != nil && deleted.Contains(uint32(num)) {
+			continue
+		}
+		hasID := false
+		err := segment.VisitStoredFields(num, func(field string, _ byte, _ []byte, _ []uint64) bool {
+			if field == "_id" {
+				hasID = true
+			}
+			return true
+		})
+		if err != nil {
+			if !fail("stored fields of document %d are unreadable: %v", num, err) {
+				return
+			}
+		} else if !hasID {
+			if !fail("document %d has no stored _id", num) {
+				return
+			}
+		}
+	}
+}
+
+// verifyHandler serves GET /admin/verify/{index}, which closes the index for
+// as long as the check takes, failing searches of it in the meantime.
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/admin/verify/")
+	if _, err := os.Stat(indexes.path(name)); name == "" || strings.ContainsAny(name, `/\`) || err != nil {
+		http.Error(w, "expected /admin/verify/{index} of an index in the data directory", http.StatusNotFound)
+		return
+	}
+
+	var report verifyReport
+	err := indexes.Exclusive(name, 5*time.Second, func(path string) error {
+		report = verifyIndex(name, path)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// verifyCommand checks indexes for damage, all of the data directory when
+// none are named, and exits with status 1 when one has errors or couldn't be
+// checked:
+//
+//	server verify -dataDir data hpotter.bleve
+//
+// The indexes must not be open in a running server, use GET
+// /admin/verify/{index} on it instead.
+func verifyCommand(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.StringVar(dataDir, "dataDir", *dataDir, "data directory of the indexes")
+	asJSON := flags.Bool("json", false, "print the reports as JSON")
+	checkBolt := flags.String("checkBolt", "", "only check the pages of this bolt file, printing a line per problem")
+	flags.Parse(args)
+
+	if *checkBolt != "" {
+		os.Exit(checkBoltPages(*checkBolt))
+	}
+
+	names := flags.Args()
+	if len(names) == 0 {
+		entries, err := ioutil.ReadDir(*dataDir)
+		if err != nil {
+			log.Fatalf("error reading data dir: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				names = append(names, entry.Name())
+			}
+		}
+		sort.Strings(names)
+	}
+
+	ok := true
+	var reports []verifyReport
+	for _, name := range names {
+		report := verifyIndex(name, filepath.Join(*dataDir, name))
+		ok = ok && report.OK
+		reports = append(reports, report)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+	} else {
+		printVerifyReports(reports)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func printVerifyReports(reports []verifyReport) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "index\tstatus\tdocs\tsegments\tsnapshots\tterms\tpostings\ttook")
+	for _, r := range reports {
+		status := "ok"
+		if r.InUse {
+			status = "in use"
+		} else if !r.OK {
+			status = "CORRUPT"
+		}
+		var terms, postings uint64
+		for _, s := range r.Segments {
+			terms += s.Terms
+			postings += s.Postings
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			r.Index, status, r.Docs, len(r.Segments), r.Snapshots, terms, postings, r.Took)
+	}
+	tw.Flush()
+
+	for _, r := range reports {
+		for _, p := range r.Problems {
+			fmt.Printf("\n%s %s: %s: %s\n", p.Severity, r.Index, p.Where, p.Problem)
+			if p.Remedy != "" {
+				fmt.Printf("  remedy: %s\n", p.Remedy)
+			}
+		}
+	}
+}
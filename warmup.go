@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var warmupQueriesPath = flag.String("warmupQueries", "",
+	"optional path of a file with one query per line to replay against every index on startup")
+var warmupTopQueries = flag.Int("warmupTopQueries", 0,
+	"number of the most frequent queries from -queryLog to replay against each index on startup")
+var warmupBudget = flag.Duration("warmupBudget", 30*time.Second,
+	"maximum time spent warming up indexes before reporting ready")
+
+// ready is set to 1 once startup warm-up has finished
+var ready int32
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&ready) == 0 {
+		http.Error(w, "warming up", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// warmup replays the configured queries against every index so that their
+// segments are paged in before the first real search, then marks the server
+// ready. It gives up once the warm-up budget is spent.
+func warmup(indexNames []string) {
+	defer atomic.StoreInt32(&ready, 1)
+
+	var staticQueries []string
+	if *warmupQueriesPath != "" {
+		var err error
+		staticQueries, err = readLines(*warmupQueriesPath)
+		if err != nil {
+			log.Printf("error reading warm-up queries: %v", err)
+		}
+	}
+
+	start := time.Now()
+	deadline := start.Add(*warmupBudget)
+	replayed := 0
+	for _, indexName := range indexNames {
+		queries := staticQueries
+		if *warmupTopQueries > 0 && *queryLogPath != "" {
+			top, err := topQueries(*queryLogPath, indexName, *warmupTopQueries)
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("error reading query log for %s: %v", indexName, err)
+			}
+			queries = append(queries[:len(queries):len(queries)], top...)
+		}
+
+		for _, q := range queries {
+			if time.Now().After(deadline) {
+				log.Printf("warm-up budget of %s spent after %d queries", *warmupBudget, replayed)
+				return
+			}
+			if _, err := performSearch(context.Background(), indexName, q, searchOptions{}); err != nil {
+				log.Printf("warm-up query %q on %s failed: %v", q, indexName, err)
+			}
+			replayed++
+		}
+	}
+	if replayed > 0 {
+		log.Printf("warm-up replayed %d queries in %s", replayed, time.Since(start))
+	}
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
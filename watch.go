@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var watchDirs = flag.String("watch", "",
+	"comma separated inbox=index pairs of directories to watch and the index their files are indexed into")
+var watchInterval = flag.Duration("watchInterval", 2*time.Second,
+	"how often watched directories are scanned for changes")
+
+// watchFileName is the file in the data dir that keeps the status of the
+// watched files across restarts, so that files deleted or shortened while
+// the server was down get their documents removed
+const watchFileName = "watch.json"
+
+// watchedFile is the indexing status of one file in an inbox
+type watchedFile struct {
+	Path    string
+	Index   string
+	Status  string // indexed, error or deleted
+	Error   string `json:",omitempty"`
+	Lines   int
+	Updated time.Time
+	ModTime time.Time
+	Size    int64
+}
+
+var watched = struct {
+	sync.Mutex
+	files map[string]*watchedFile
+	dirty bool // changed since it was last saved
+}{files: map[string]*watchedFile{}}
+
+func watchFilePath() string {
+	return *dataDir + string(os.PathSeparator) + watchFileName
+}
+
+func loadWatched() error {
+	data, err := ioutil.ReadFile(watchFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var files []*watchedFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return fmt.Errorf("parsing %s: %v", watchFileName, err)
+	}
+	watched.Lock()
+	defer watched.Unlock()
+	for _, f := range files {
+		watched.files[f.Path] = f
+	}
+	return nil
+}
+
+func saveWatched() error {
+	watched.Lock()
+	defer watched.Unlock()
+	if !watched.dirty {
+		return nil
+	}
+
+	files := make([]*watchedFile, 0, len(watched.files))
+	for _, f := range watched.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := watchFilePath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, watchFilePath()); err != nil {
+		return err
+	}
+	watched.dirty = false
+	return nil
+}
+
+// startWatching parses the -watch flag and polls every inbox in the
+// background. Files are indexed a line per document like the ingest command
+// does, through the same write path as the document API.
+func startWatching() error {
+	if *watchDirs == "" {
+		return nil
+	}
+	if *readOnly {
+		return fmt.Errorf("cannot watch inboxes of a read only server")
+	}
+
+	inboxes := map[string]string{}
+	for _, pair := range strings.Split(*watchDirs, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid -watch entry %q, expected inbox=index", pair)
+		}
+		// the status is kept by absolute path, whatever directory the server
+		// is started from
+		dir, err := filepath.Abs(parts[0])
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("inbox %s is not a directory", parts[0])
+		}
+		inboxes[dir] = parts[1]
+	}
+	if err := loadWatched(); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			for dir, indexName := range inboxes {
+				scanInbox(dir, indexName)
+			}
+			if err := saveWatched(); err != nil {
+				log.Printf("error saving the status of watched files: %v", err)
+			}
+			time.Sleep(*watchInterval)
+		}
+	}()
+	return nil
+}
+
+func scanInbox(dir string, indexName string) {
+	seen := map[string]bool{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		seen[path] = true
+
+		// leave files alone while they are still being written
+		if time.Since(info.ModTime()) < *watchInterval {
+			return nil
+		}
+
+		watched.Lock()
+		f, ok := watched.files[path]
+		watched.Unlock()
+		if ok && f.Status != "deleted" && f.ModTime.Equal(info.ModTime()) && f.Size == info.Size() {
+			return nil
+		}
+		indexWatchedFile(dir, path, indexName, info, f)
+		return nil
+	})
+	if err != nil {
+		log.Printf("error scanning inbox %s: %v", dir, err)
+	}
+
+	watched.Lock()
+	var deleted []*watchedFile
+	for path, f := range watched.files {
+		if f.Index == indexName && f.Status != "deleted" && isUnder(path, dir) && !seen[path] {
+			deleted = append(deleted, f)
+		}
+	}
+	watched.Unlock()
+
+	for _, f := range deleted {
+		writes := make([]docWrite, f.Lines)
+		for n := 1; n <= f.Lines; n++ {
+			writes[n-1] = docWrite{id: watchedDocID(dir, f.Path, n)}
+		}
+		updateWatched(f.Path, indexName, "deleted", 0, writeDocuments(indexName, writes), time.Time{}, 0)
+	}
+}
+
+// watchedDocID is the ID of the document for line n of a file in an inbox.
+// Unlike the ingest command, it uses the path of the file in the inbox, so
+// that files of the same name in different directories, or with different
+// extensions, don't overwrite each other.
+func watchedDocID(dir string, path string, n int) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		rel = path
+	}
+	return fmt.Sprintf("%s: %d", filepath.ToSlash(rel), n)
+}
+
+func indexWatchedFile(dir string, path string, indexName string, info os.FileInfo, prev *watchedFile) {
+	docID := func(n int) string { return watchedDocID(dir, path, n) }
+	var writes []docWrite
+	err := readLineDocs(path, docID, func(id string, doc map[string]interface{}) error {
+		writes = append(writes, docWrite{id: id, doc: doc})
+		return nil
+	})
+	lines := len(writes)
+
+	// a file that got shorter leaves documents behind for its old last lines
+	if err == nil && prev != nil {
+		for n := lines + 1; n <= prev.Lines; n++ {
+			writes = append(writes, docWrite{id: docID(n)})
+		}
+	}
+	if err == nil {
+		err = writeDocuments(indexName, writes)
+	}
+	updateWatched(path, indexName, "indexed", lines, err, info.ModTime(), info.Size())
+}
+
+func updateWatched(path, indexName, status string, lines int, err error, modTime time.Time, size int64) {
+	watched.Lock()
+	defer watched.Unlock()
+
+	f := &watchedFile{
+		Path:    path,
+		Index:   indexName,
+		Status:  status,
+		Lines:   lines,
+		Updated: time.Now(),
+		ModTime: modTime,
+		Size:    size,
+	}
+	if err != nil {
+		log.Printf("error indexing watched file %s: %v", path, err)
+		f.Status = "error"
+		f.Error = err.Error()
+		f.ModTime = time.Time{}
+		if prev, ok := watched.files[path]; ok {
+			// keep the old line count so the next attempt cleans up after it
+			f.Lines = prev.Lines
+		}
+	} else {
+		log.Printf("watched file %s: %s in %s", path, status, indexName)
+	}
+	watched.files[path] = f
+	watched.dirty = true
+}
+
+func isUnder(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// watchHandler lists the status of every file seen in a watched inbox.
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	watched.Lock()
+	files := make([]watchedFile, 0, len(watched.files))
+	for _, f := range watched.files {
+		files = append(files, *f)
+	}
+	watched.Unlock()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	writeJSON(w, http.StatusOK, files)
+}